@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/context"
+	"github.com/irrenhaus/pushmearound_server/httpresponse"
+	"github.com/irrenhaus/pushmearound_server/models"
+)
+
+func quotaExceeded() httpresponse.HttpResponse {
+	return httpresponse.Error(http.StatusInsufficientStorage, "Storage quota exceeded")
+}
+
+func writeQuotaExceeded(resp http.ResponseWriter) {
+	quotaExceeded().WriteJSON(resp)
+}
+
+// updateStorageUsage recomputes the cached storage usage of the user after
+// files were added or removed
+func updateStorageUsage(userID uint) {
+	if _, err := models.RecomputeStorageUsage(DB, userID); err != nil {
+		log.WithFields(log.Fields{"user": userID, "error": err}).Error("SQL error while recomputing storage usage")
+	}
+}
+
+func AccountUsageHandler(resp http.ResponseWriter, req *http.Request) {
+	user, ok := context.Get(req, ContextKeyUser).(models.User)
+	if !ok {
+		httpresponse.InternalServerError("Could not convert user").WriteJSON(resp)
+		return
+	}
+
+	usage, err := models.RecomputeStorageUsage(DB, user.ID)
+	if err != nil {
+		log.WithFields(log.Fields{"user": user.ID, "error": err}).Error("SQL error while recomputing storage usage")
+		httpresponse.InternalServerError("Could not compute storage usage").WriteJSON(resp)
+		return
+	}
+
+	limits, err := user.StorageLimits(DB)
+	if err != nil {
+		log.WithFields(log.Fields{"user": user.ID, "error": err}).Error("SQL error while loading storage limits")
+		httpresponse.InternalServerError("Could not load storage limits").WriteJSON(resp)
+		return
+	}
+
+	// Limits are null if unlimited
+	data := map[string]interface{}{
+		"plan":              limits.Plan,
+		"storage_bytes":     usage.Bytes,
+		"storage_files":     usage.Files,
+		"max_storage_bytes": nil,
+		"max_files":         nil,
+		"max_upload_size":   user.UploadLimit(*maxUploadSize),
+	}
+
+	if limits.MaxBytes.Valid {
+		data["max_storage_bytes"] = limits.MaxBytes.Int64
+	}
+
+	if limits.MaxFiles.Valid {
+		data["max_files"] = limits.MaxFiles.Int64
+	}
+
+	response := httpresponse.Success("")
+	response.Data = data
+	response.WriteJSON(resp)
+}
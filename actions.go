@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/irrenhaus/pushmearound_server/events"
+	"github.com/irrenhaus/pushmearound_server/httpresponse"
+	"github.com/irrenhaus/pushmearound_server/models"
+	"github.com/irrenhaus/pushmearound_server/unfurl"
+)
+
+// Client used for action callbacks, it only connects to public addresses
+var CallbackClient *http.Client
+
+// Header carrying the HMAC-SHA256 of the callback body, keyed with the
+// callback secret returned when sending the message
+const callbackSignatureHeader = "X-Pushmearound-Signature"
+
+// Delays before retrying a failed callback. Once they are used up the
+// callback is given up.
+var callbackRetryDelays = []time.Duration{10 * time.Second, time.Minute}
+
+type callbackJob struct {
+	MessageID uint
+	URL       string
+	Secret    string
+	Body      []byte
+	Attempt   int
+}
+
+// Callbacks waiting to be delivered. If the queue is full the callback is
+// dropped, the sender still gets the reply message.
+var callbackQueue = make(chan callbackJob, 64)
+
+func setupCallbacks() {
+	CallbackClient = unfurl.NewPublicClient(*callbackTimeout)
+}
+
+func newCallbackSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(secret), nil
+}
+
+// queueCallback schedules posting the chosen action to the callback URL of
+// the message
+func queueCallback(msg models.Message, action models.Action, deviceID string) {
+	body, err := json.Marshal(map[string]interface{}{
+		"message_id":   msg.ID,
+		"action":       action.ID,
+		"label":        action.Label,
+		"device_id":    deviceID,
+		"responded_at": msg.RespondedAt.Time,
+	})
+	if err != nil {
+		log.WithFields(log.Fields{"message": msg.ID, "error": err}).Error("Could not encode callback")
+		return
+	}
+
+	enqueueCallback(callbackJob{
+		MessageID: msg.ID,
+		URL:       msg.CallbackURL,
+		Secret:    msg.CallbackSecret,
+		Body:      body,
+	})
+}
+
+func enqueueCallback(job callbackJob) {
+	select {
+	case callbackQueue <- job:
+	default:
+		log.WithFields(log.Fields{"message": job.MessageID}).Warn("Callback queue is full, dropping callback")
+	}
+}
+
+// runCallbacks delivers the queued callbacks in the background
+func runCallbacks() {
+	for job := range callbackQueue {
+		err := postCallback(job)
+		if err == nil {
+			continue
+		}
+
+		if job.Attempt >= len(callbackRetryDelays) {
+			log.WithFields(log.Fields{"message": job.MessageID, "url": job.URL, "error": err}).Warn("Giving up on callback")
+			continue
+		}
+
+		log.WithFields(log.Fields{"message": job.MessageID, "url": job.URL, "error": err}).Info("Callback failed, retrying")
+
+		retry := job
+		retry.Attempt++
+		time.AfterFunc(callbackRetryDelays[job.Attempt], func() {
+			enqueueCallback(retry)
+		})
+	}
+}
+
+func postCallback(job callbackJob) error {
+	req, err := http.NewRequest("POST", job.URL, bytes.NewReader(job.Body))
+	if err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, []byte(job.Secret))
+	mac.Write(job.Body)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "pushmearound callback")
+	req.Header.Set(callbackSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := CallbackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// sendActionReply delivers the chosen action to the device which sent the
+// message, as a message of its own
+func sendActionReply(msg models.Message, action models.Action, device models.Device) {
+	if msg.DeviceID == device.ID {
+		return
+	}
+
+	reply := models.Message{
+		UserID:      msg.UserID,
+		DeviceID:    device.ID,
+		ContentType: models.ContentTypeMessage,
+		Title:       msg.Title,
+		Msg:         action.Label,
+		ReplyTo:     msg.ID,
+		ThreadID:    msg.ThreadID,
+	}
+	if reply.Title != "" {
+		reply.Title = "Re: " + reply.Title
+	}
+
+	if err := reply.Create(DB); err != nil {
+		log.WithFields(log.Fields{"message": msg.ID, "error": err}).Error("SQL error while creating action reply")
+		return
+	}
+
+	// The sending device might be gone by now
+	if sendMessageToDevice(reply, msg.DeviceID, "") == nil {
+		reply.Delete(DB)
+	}
+}
+
+// MessageActionHandler records the action a device picked for a message.
+// The sender is told through a reply message and its callback URL.
+func MessageActionHandler(resp http.ResponseWriter, req *http.Request) {
+	user, ok := context.Get(req, ContextKeyUser).(models.User)
+	if !ok {
+		httpresponse.InternalServerError("Could not convert user").WriteJSON(resp)
+		return
+	}
+
+	vars := mux.Vars(req)
+	msgID, err := strconv.ParseUint(vars["msg"], 10, 32)
+	if err != nil {
+		httpresponse.BadRequest("Invalid message ID").WriteJSON(resp)
+		return
+	}
+
+	device, err := models.FindDevice(DB, req.FormValue("device"))
+	if err != nil || device.UserID != user.ID {
+		httpresponse.BadRequest("No such device").WriteJSON(resp)
+		return
+	}
+
+	// Only devices which got the message may answer it
+	if _, err := models.FindReceivedMessageByMessageAndDevice(DB, uint(msgID), device.ID); err != nil {
+		if err != sql.ErrNoRows {
+			log.WithFields(log.Fields{"user": user.ID, "msg": msgID, "device": device.ID, "error": err}).Error("SQL error while finding received message")
+		}
+
+		httpresponse.NotFound("No such message").WriteJSON(resp)
+		return
+	}
+
+	msg, action, err := models.RespondToMessage(DB, user.ID, uint(msgID), req.FormValue("action"))
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			httpresponse.NotFound("No such message").WriteJSON(resp)
+		case models.ErrNoSuchAction:
+			httpresponse.NotFound(err.Error()).WriteJSON(resp)
+		case models.ErrAlreadyAnswered:
+			httpresponse.Error(http.StatusConflict, err.Error()).WriteJSON(resp)
+		default:
+			log.WithFields(log.Fields{"user": user.ID, "msg": msgID, "error": err}).Error("SQL error while responding to message")
+			httpresponse.InternalServerError("Responding to the message failed").WriteJSON(resp)
+		}
+		return
+	}
+
+	Events.Publish(user.ID, events.Event{
+		Type:           events.TypeActionChosen,
+		OriginDeviceID: device.ID,
+		Data: map[string]interface{}{
+			"message_id": msg.ID,
+			"action":     action.ID,
+		},
+	})
+
+	sendActionReply(msg, action, device)
+
+	if msg.CallbackURL != "" {
+		queueCallback(msg, action, device.ID)
+	}
+
+	response := httpresponse.Success("")
+	response.Data = map[string]interface{}{
+		"message_id": msg.ID,
+		"action":     action.ID,
+	}
+	response.WriteJSON(resp)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/irrenhaus/pushmearound_server/models"
+)
+
+func TestActionReply(t *testing.T) {
+	setupTestDatabase(t)
+
+	user, devices := createTestUser(t, "asker", 2)
+
+	actions, err := models.ValidateActions([]byte(`[{"id": "yes", "label": "Yes"}, {"id": "no", "label": "No"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := models.Message{
+		UserID:      user.ID,
+		DeviceID:    devices[0].ID,
+		ContentType: models.ContentTypeURL,
+		Title:       "Dinner?",
+		URL:         "https://example.com/menu",
+		Actions:     actions,
+	}
+	if err := msg.Create(DB); err != nil {
+		t.Fatal(err)
+	}
+	if sendMessageToDevice(msg, devices[1].ID, "") == nil {
+		t.Fatal("Could not deliver the message")
+	}
+
+	req := httptest.NewRequest("POST", fmt.Sprintf("/msg/%d/action?device=%s&action=yes", msg.ID, devices[1].ID), nil)
+	decodeResponse(t, serveAs(user, MessageActionHandler, "POST", "/msg/{msg:[0-9]+}/action", req), 200, nil)
+
+	// The sending device gets the answer as a text message
+	received, err := models.FindReceivedMessagesByDevice(DB, devices[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 1 {
+		t.Fatalf("The sender received %d messages, want the reply", len(received))
+	}
+
+	reply, err := models.FindMessage(DB, received[0].MessageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reply.ContentType != models.ContentTypeMessage || reply.ReplyTo != msg.ID || reply.DeviceID != devices[1].ID {
+		t.Errorf("Stored reply %+v", reply)
+	}
+	if reply.Title != "Re: Dinner?" || reply.Msg != "Yes" {
+		t.Errorf("The reply reads %q: %q", reply.Title, reply.Msg)
+	}
+}
@@ -174,8 +174,10 @@ func AuthMiddleware(w http.ResponseWriter, r *http.Request, next http.HandlerFun
 
 	// Check if the token was given via HTTP params
 	if token == nil || accessToken == nil || err != nil {
+		// Don't use FormValue here, it would parse (and buffer) multipart
+		// bodies before the handler had a chance to stream them
 		if r.ParseForm() == nil {
-			tokenString := r.FormValue("token")
+			tokenString := r.Form.Get("token")
 			if len(tokenString) > 0 {
 				token, accessToken, err = authenticateToken(tokenString)
 			}
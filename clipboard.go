@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/context"
+	"github.com/irrenhaus/pushmearound_server/events"
+	"github.com/irrenhaus/pushmearound_server/httpresponse"
+	"github.com/irrenhaus/pushmearound_server/models"
+)
+
+// Images copied to the clipboard may not be larger than this
+const maxClipboardImageSize = 5 * 1024 * 1024
+
+// validateClipboard checks that a clipboard entry is either text or a single
+// image
+func validateClipboard(msg models.Message, attachments []models.Attachment) error {
+	if msg.URL != "" {
+		return errors.New("Clipboard entries can't carry an URL")
+	}
+
+	switch len(attachments) {
+	case 0:
+		if msg.Msg == "" {
+			return errors.New("Clipboard entries need a text or an image")
+		}
+	case 1:
+		if msg.Msg != "" {
+			return errors.New("Clipboard entries are either text or an image")
+		}
+
+		if !strings.HasPrefix(attachments[0].MimeType, "image/") {
+			return errors.New("Only images can be copied to the clipboard")
+		}
+
+		if attachments[0].Size > maxClipboardImageSize {
+			return errors.New("The image is too large for the clipboard")
+		}
+	default:
+		return errors.New("Clipboard entries can only carry one image")
+	}
+
+	return nil
+}
+
+// syncClipboard pushes a new clipboard entry to the other devices of the user
+// and forgets about the entries beyond the configured history
+func syncClipboard(msg models.Message) {
+	Events.Publish(msg.UserID, events.Event{
+		Type:           events.TypeClipboardChanged,
+		OriginDeviceID: msg.DeviceID,
+		Data:           msg,
+	})
+
+	outdated, err := models.FindOutdatedClipboardMessages(DB, msg.UserID, *clipboardHistory)
+	if err != nil {
+		log.WithFields(log.Fields{"user": msg.UserID, "error": err}).Error("SQL error while finding outdated clipboard entries")
+		return
+	}
+
+	releasedFiles := false
+	for _, entry := range outdated {
+		if err := entry.Recall(DB); err != nil {
+			log.WithFields(log.Fields{"msg": entry.ID, "error": err}).Error("Could not delete outdated clipboard entry")
+			continue
+		}
+
+		if len(entry.Attachments) > 0 {
+			releaseAttachments(entry.Attachments)
+			releasedFiles = true
+		}
+
+		Events.Publish(entry.UserID, events.Event{
+			Type: events.TypeMessageRecalled,
+			Data: map[string]uint{
+				"message_id": entry.ID,
+			},
+		})
+	}
+
+	if releasedFiles {
+		updateStorageUsage(msg.UserID)
+	}
+}
+
+// ClipboardHandler lists the latest clipboard entries of the user, newest
+// first
+func ClipboardHandler(resp http.ResponseWriter, req *http.Request) {
+	user, ok := context.Get(req, ContextKeyUser).(models.User)
+	if !ok {
+		httpresponse.InternalServerError("Could not convert user").WriteJSON(resp)
+		return
+	}
+
+	msgs, err := models.FindClipboardMessages(DB, user.ID, *clipboardHistory)
+	if err != nil {
+		log.WithFields(log.Fields{"user": user.ID, "error": err}).Error("SQL error while loading clipboard entries")
+		httpresponse.InternalServerError("Could not load the clipboard").WriteJSON(resp)
+		return
+	}
+
+	response := httpresponse.Success("")
+	response.Data = msgs
+	response.WriteJSON(resp)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/irrenhaus/pushmearound_server/encryption"
+	"github.com/irrenhaus/pushmearound_server/models"
+	"github.com/irrenhaus/pushmearound_server/storage"
+	"github.com/mattes/migrate/migrate"
+)
+
+// Tests which need a database run against the PostgreSQL database given as
+// URL in this variable, e.g.
+// postgres://localhost/pushmearound_test?user=pushmearound&sslmode=disable.
+// Everything in it is wiped before each test. Without it the tests are
+// skipped.
+const testDatabaseEnv = "PUSHMEAROUND_TEST_DATABASE"
+
+var testMigration struct {
+	sync.Once
+	errors []error
+}
+
+// setupTestDatabase connects DB to an empty, fully migrated test database and
+// resets the blob storage, scanner and encryption to their defaults
+func setupTestDatabase(t *testing.T) {
+	url := os.Getenv(testDatabaseEnv)
+	if url == "" {
+		t.Skipf("%s is not set", testDatabaseEnv)
+	}
+
+	testMigration.Do(func() {
+		if errs, ok := migrate.UpSync(url, "./migrations"); !ok {
+			testMigration.errors = append(errs, fmt.Errorf("Migrating %s failed", url))
+		}
+	})
+	if len(testMigration.errors) > 0 {
+		t.Fatal(testMigration.errors)
+	}
+
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	DB = db
+
+	// Everything else references the users, plans are part of the schema
+	if _, err := DB.Exec("TRUNCATE users, blobs RESTART IDENTITY CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+
+	BlobStorage = storage.NewMemory()
+	UploadScanner = nil
+	models.Sealer = fieldSealer{}
+	setTestMasterKey(t, nil)
+}
+
+// setTestMasterKey enables encryption at rest with the given master key, or
+// disables it. Cached data keys are dropped, the IDs start over with every
+// test.
+func setTestMasterKey(t *testing.T, master *encryption.Master) {
+	dataKeys.Lock()
+	dataKeys.byID = map[uint][]byte{}
+	dataKeys.byUser = map[uint]encryption.Key{}
+	dataKeys.Unlock()
+
+	MasterKey = master
+	t.Cleanup(func() { MasterKey = nil })
+}
+
+// createTestUser creates a user with the given number of devices
+func createTestUser(t *testing.T, name string, devices int) (models.User, []models.Device) {
+	user := models.User{
+		Username: name,
+		Email:    name + "@example.com",
+	}
+	if err := user.SetPassword("secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := user.Create(DB); err != nil {
+		t.Fatal(err)
+	}
+
+	created := []models.Device{}
+	for i := 0; i < devices; i++ {
+		device := models.Device{
+			UserID:   user.ID,
+			Platform: "android",
+			Name:     fmt.Sprintf("device %d", i),
+		}
+		if err := device.Create(DB); err != nil {
+			t.Fatal(err)
+		}
+		created = append(created, device)
+	}
+
+	// Pick up the defaults of the columns Create doesn't return
+	user, err := models.FindUser(DB, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user, created
+}
+
+// serveAs runs the handler for req like the router does for an authenticated
+// user. pattern is the route of the handler, for its path variables.
+func serveAs(user models.User, handler http.HandlerFunc, method string, pattern string, req *http.Request) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	router.HandleFunc(pattern, func(resp http.ResponseWriter, req *http.Request) {
+		context.Set(req, ContextKeyUser, user)
+		defer context.Clear(req)
+
+		handler(resp, req)
+	}).Methods(method)
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	return resp
+}
+
+type testFile struct {
+	Name    string
+	Content string
+}
+
+// newSendRequest builds a send request with the form fields followed by the
+// files
+func newSendRequest(t *testing.T, fields map[string]string, files ...testFile) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	for name, value := range fields {
+		if err := writer.WriteField(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, file := range files {
+		part, err := writer.CreateFormFile("sendfile", file.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(part, file.Content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/msg/send", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	return req
+}
+
+// testResponse is the JSON written by httpresponse
+type testResponse struct {
+	Status int
+	Error  string
+	Msg    string
+	Data   json.RawMessage
+}
+
+// decodeResponse checks the status of a response and decodes its data into
+// data, if given
+func decodeResponse(t *testing.T, resp *httptest.ResponseRecorder, status int, data interface{}) testResponse {
+	t.Helper()
+
+	response := testResponse{}
+	if err := json.Unmarshal(resp.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Invalid response %q: %s", resp.Body.String(), err)
+	}
+
+	if resp.Code != status {
+		t.Fatalf("Got status %d (%s), want %d", resp.Code, response.Error, status)
+	}
+
+	if data != nil {
+		if err := json.Unmarshal(response.Data, data); err != nil {
+			t.Fatalf("Invalid response data %s: %s", response.Data, err)
+		}
+	}
+
+	return response
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	log "github.com/Sirupsen/logrus"
@@ -12,15 +14,36 @@ import (
 	"github.com/irrenhaus/pushmearound_server/models"
 )
 
+// Length of X25519 public keys
+const devicePublicKeySize = 32
+
+// parsePublicKey checks that key is a base64 encoded X25519 public key
+func parsePublicKey(key string) error {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(raw) != devicePublicKeySize {
+		return errors.New("public_key has to be a base64 encoded X25519 public key")
+	}
+
+	return nil
+}
+
 func DeviceCreateHandler(resp http.ResponseWriter, req *http.Request) {
 	platform := req.FormValue("platform")
 	name := req.FormValue("name")
+	publicKey := req.FormValue("public_key")
 
 	if name == "" || !models.DevicePlatforms[platform] {
 		httpresponse.BadRequest("Please specify device name and a valid platform").WriteJSON(resp)
 		return
 	}
 
+	if publicKey != "" {
+		if err := parsePublicKey(publicKey); err != nil {
+			httpresponse.BadRequest(err.Error()).WriteJSON(resp)
+			return
+		}
+	}
+
 	user, ok := context.Get(req, ContextKeyUser).(models.User)
 	if !ok || user.ID == 0 {
 		httpresponse.InternalServerError("No user object found").WriteJSON(resp)
@@ -28,9 +51,10 @@ func DeviceCreateHandler(resp http.ResponseWriter, req *http.Request) {
 	}
 
 	device := models.Device{
-		UserID:   user.ID,
-		Platform: platform,
-		Name:     name,
+		UserID:    user.ID,
+		Platform:  platform,
+		Name:      name,
+		PublicKey: publicKey,
 		Options: models.DeviceOptions{
 			PushNotifications: true,
 		},
@@ -125,3 +149,82 @@ func DeviceGetHandler(resp http.ResponseWriter, req *http.Request) {
 	response.Data = device
 	response.WriteJSON(resp)
 }
+
+// DeviceKeyHandler registers or replaces the public key messages are encrypted
+// for the device with
+func DeviceKeyHandler(resp http.ResponseWriter, req *http.Request) {
+	user, ok := context.Get(req, ContextKeyUser).(models.User)
+	if !ok || user.ID == 0 {
+		httpresponse.InternalServerError("No user object found").WriteJSON(resp)
+		return
+	}
+
+	deviceID := req.FormValue("device")
+	if deviceID == "" {
+		httpresponse.BadRequest("No device specified").WriteJSON(resp)
+		return
+	}
+
+	publicKey := req.FormValue("public_key")
+	if err := parsePublicKey(publicKey); err != nil {
+		httpresponse.BadRequest(err.Error()).WriteJSON(resp)
+		return
+	}
+
+	device, err := models.FindDevice(DB, deviceID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.WithFields(log.Fields{"user": user.ID, "device": deviceID, "error": err}).Error("SQL error while loading device")
+		}
+
+		httpresponse.NotFound("No such device").WriteJSON(resp)
+		return
+	}
+
+	if device.UserID != user.ID {
+		httpresponse.NotFound("No such device").WriteJSON(resp)
+		return
+	}
+
+	if err := device.UpdatePublicKey(DB, publicKey); err != nil {
+		log.WithFields(log.Fields{"user": user.ID, "device": deviceID, "error": err}).Error("SQL error while updating device key")
+		httpresponse.InternalServerError("Updating the key failed").WriteJSON(resp)
+		return
+	}
+
+	httpresponse.Success("").WriteJSON(resp)
+}
+
+// DeviceKeysHandler lists the public keys of the users devices so that
+// senders can wrap message keys for them
+func DeviceKeysHandler(resp http.ResponseWriter, req *http.Request) {
+	user, ok := context.Get(req, ContextKeyUser).(models.User)
+	if !ok || user.ID == 0 {
+		httpresponse.InternalServerError("No user object found").WriteJSON(resp)
+		return
+	}
+
+	devices, err := models.FindDevicesByUserID(DB, user.ID)
+	if err != nil {
+		log.WithFields(log.Fields{"user": user.ID, "error": err}).Error("SQL error while loading devices")
+		httpresponse.InternalServerError("Error finding users devices").WriteJSON(resp)
+		return
+	}
+
+	keys := []map[string]string{}
+	for _, device := range devices {
+		if device.PublicKey == "" {
+			continue
+		}
+
+		keys = append(keys, map[string]string{
+			"device_id":  device.ID,
+			"name":       device.Name,
+			"public_key": device.PublicKey,
+		})
+	}
+
+	response := httpresponse.Success("")
+	response.Data = keys
+	response.WriteJSON(resp)
+}
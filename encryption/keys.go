@@ -0,0 +1,195 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// KeySize is the size of master and data keys, selecting AES-256
+const KeySize = 32
+
+// Prefix of sealed strings, followed by the data key ID and the ciphertext
+const sealedPrefix = "enc:v1:"
+
+var ErrInvalidKey = errors.New("Invalid encryption key")
+var ErrMalformed = errors.New("Malformed ciphertext")
+
+// Key is an unwrapped data key together with the ID it is stored under
+type Key struct {
+	ID  uint
+	Key []byte
+}
+
+// Master wraps and unwraps the data keys. It never encrypts content itself.
+type Master struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// NewMaster creates a master key from the raw key bytes
+func NewMaster(key []byte) (*Master, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// The ID tells which master key a data key was wrapped with without
+	// revealing the key
+	sum := sha256.Sum256(key)
+
+	return &Master{
+		id:   hex.EncodeToString(sum[:8]),
+		aead: aead,
+	}, nil
+}
+
+// ParseMaster reads a base64 encoded master key as found in the key file
+func ParseMaster(encoded string) (*Master, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+
+	return NewMaster(key)
+}
+
+func (m *Master) ID() string {
+	return m.id
+}
+
+// NewDataKey generates a random data key and returns it wrapped with the
+// master key
+func (m *Master) NewDataKey() ([]byte, string, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, "", err
+	}
+
+	wrapped, err := m.Wrap(key)
+	return key, wrapped, err
+}
+
+// Wrap encrypts a data key with the master key
+func (m *Master) Wrap(key []byte) (string, error) {
+	sealed, err := seal(m.aead, key)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Unwrap decrypts a data key wrapped by Wrap
+func (m *Master) Unwrap(wrapped string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	return open(m.aead, sealed)
+}
+
+// IsSealed reports whether value was produced by Seal
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix)
+}
+
+// Seal encrypts a string with the data key. Empty strings stay empty.
+func Seal(key Key, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	aead, err := newAEAD(key.Key)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := seal(aead, []byte(value))
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s%d:%s", sealedPrefix, key.ID, base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// Open decrypts a string encrypted by Seal, looking up the data key by its ID.
+// Callers have to know whether a value is sealed, anything but an empty
+// string or a value produced by Seal is refused as malformed.
+func Open(lookup func(id uint) ([]byte, error), value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	if !IsSealed(value) {
+		return "", ErrMalformed
+	}
+
+	fields := strings.SplitN(strings.TrimPrefix(value, sealedPrefix), ":", 2)
+	if len(fields) != 2 {
+		return "", ErrMalformed
+	}
+
+	id, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return "", ErrMalformed
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return "", ErrMalformed
+	}
+
+	key, err := lookup(uint(id))
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := open(aead, sealed)
+	return string(plaintext), err
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts with a random nonce which is prepended to the ciphertext
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrMalformed
+	}
+
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+}
@@ -0,0 +1,261 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Streams are encrypted in chunks so that they can be decrypted starting at
+// any offset. Every chunk is sealed on its own with a nonce derived from its
+// index. The last chunk is marked so that truncated streams are detected.
+//
+// The header consists of the magic, the ID of the data key and the random
+// nonce prefix of the stream.
+const (
+	streamMagic     = "\x00PMAENC1"
+	headerSize      = len(streamMagic) + 4 + 8
+	chunkSize       = 64 * 1024
+	tagSize         = 16
+	sealedChunkSize = chunkSize + tagSize
+)
+
+func chunkNonce(prefix []byte, index uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[8:], index)
+	return nonce
+}
+
+func chunkAAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+
+	return []byte{0}
+}
+
+type encryptReader struct {
+	src   *bufio.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	index uint32
+	plain []byte
+	out   []byte
+	buf   []byte
+	done  bool
+}
+
+// NewEncryptReader returns a reader yielding the encrypted form of everything
+// read from src
+func NewEncryptReader(key Key, src io.Reader) (io.Reader, error) {
+	aead, err := newAEAD(key.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, headerSize)
+	copy(header, streamMagic)
+	binary.BigEndian.PutUint32(header[len(streamMagic):], uint32(key.ID))
+
+	prefix := header[len(streamMagic)+4:]
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
+	}
+
+	return &encryptReader{
+		src:   bufio.NewReaderSize(src, chunkSize),
+		aead:  aead,
+		nonce: append([]byte{}, prefix...),
+		plain: make([]byte, chunkSize),
+		out:   make([]byte, 0, sealedChunkSize),
+		buf:   header,
+	}, nil
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.buf) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+
+		if err := e.sealChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, e.buf)
+	e.buf = e.buf[n:]
+	return n, nil
+}
+
+func (e *encryptReader) sealChunk() error {
+	n, err := io.ReadFull(e.src, e.plain)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	final := err != nil
+	if !final {
+		// A full chunk is the last one if nothing follows it
+		if _, err := e.src.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	e.buf = e.aead.Seal(e.out[:0], chunkNonce(e.nonce, e.index), e.plain[:n], chunkAAD(final))
+	e.index++
+	e.done = final
+	return nil
+}
+
+type decryptReader struct {
+	src    io.ReadSeeker
+	aead   cipher.AEAD
+	nonce  []byte
+	size   int64
+	chunks int64
+	pos    int64
+	// Index of the chunk in plain, -1 if none is loaded
+	chunk  int64
+	plain  []byte
+	sealed []byte
+}
+
+// NewReader decrypts a stream written by NewEncryptReader, looking up the
+// data key by the ID in its header. Seeking is supported. Streams not starting
+// with the magic were stored before encryption was enabled and are returned
+// as they are.
+func NewReader(src io.ReadSeeker, lookup func(id uint) ([]byte, error)) (io.ReadSeeker, error) {
+	cipherSize, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(src, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	if n < len(streamMagic) || !bytes.Equal(header[:len(streamMagic)], []byte(streamMagic)) {
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+
+		return src, nil
+	}
+
+	if n < headerSize {
+		return nil, ErrMalformed
+	}
+
+	key, err := lookup(uint(binary.BigEndian.Uint32(header[len(streamMagic):])))
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	body := cipherSize - int64(headerSize)
+	chunks := (body + sealedChunkSize - 1) / sealedChunkSize
+	if chunks == 0 {
+		return nil, ErrMalformed
+	}
+
+	last := body - (chunks-1)*sealedChunkSize
+	if last < tagSize {
+		return nil, ErrMalformed
+	}
+
+	r := &decryptReader{
+		src:    src,
+		aead:   aead,
+		nonce:  header[len(streamMagic)+4:],
+		size:   (chunks-1)*chunkSize + last - tagSize,
+		chunks: chunks,
+		chunk:  -1,
+		sealed: make([]byte, sealedChunkSize),
+	}
+
+	// Reading stops before an empty final chunk, so it would never be checked.
+	// A stream cut right behind the tag of the last chunk would pass then.
+	if last == tagSize {
+		if err := r.load(chunks - 1); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+
+	index := r.pos / chunkSize
+	if index != r.chunk {
+		if err := r.load(index); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.plain[r.pos-index*chunkSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *decryptReader) load(index int64) error {
+	r.chunk = -1
+
+	if _, err := r.src.Seek(int64(headerSize)+index*sealedChunkSize, io.SeekStart); err != nil {
+		return err
+	}
+
+	n, err := io.ReadFull(r.src, r.sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	plain, err := r.aead.Open(r.plain[:0], chunkNonce(r.nonce, uint32(index)), r.sealed[:n], chunkAAD(index == r.chunks-1))
+	if err != nil {
+		return err
+	}
+
+	r.plain = plain
+	r.chunk = index
+	return nil
+}
+
+func (r *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return r.pos, errors.New("Invalid whence")
+	}
+
+	if offset < 0 {
+		return r.pos, errors.New("Negative position")
+	}
+
+	r.pos = offset
+	return r.pos, nil
+}
@@ -0,0 +1,291 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+var testKey = Key{ID: 42, Key: bytes.Repeat([]byte{1}, KeySize)}
+
+func testLookup(id uint) ([]byte, error) {
+	if id != testKey.ID {
+		return nil, errors.New("Unknown key")
+	}
+
+	return testKey.Key, nil
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+func encryptStream(t *testing.T, plain []byte) []byte {
+	t.Helper()
+
+	r, err := NewEncryptReader(testKey, bytes.NewReader(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sealed
+}
+
+// decryptStream decrypts a whole stream, failing either when opening it or
+// while reading
+func decryptStream(sealed []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(sealed), testLookup)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(r)
+}
+
+// sealedChunk returns the bounds of a chunk within a stream
+func sealedChunk(index int) (int, int) {
+	start := headerSize + index*sealedChunkSize
+	return start, start + sealedChunkSize
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 17} {
+		plain := testData(size)
+		sealed := encryptStream(t, plain)
+
+		if size > 0 && bytes.Contains(sealed, plain[:size/2+1]) {
+			t.Errorf("%d bytes: the plaintext shows in the stream", size)
+		}
+
+		decrypted, err := decryptStream(sealed)
+		if err != nil {
+			t.Errorf("%d bytes: %s", size, err)
+			continue
+		}
+
+		if !bytes.Equal(decrypted, plain) {
+			t.Errorf("%d bytes: decrypted %d different bytes", size, len(decrypted))
+		}
+	}
+}
+
+func TestStreamNonceIsRandom(t *testing.T) {
+	plain := testData(100)
+	if bytes.Equal(encryptStream(t, plain), encryptStream(t, plain)) {
+		t.Error("Encrypting the same data twice yields the same stream")
+	}
+}
+
+func TestStreamWithoutHeader(t *testing.T) {
+	// Files stored before encryption was enabled are read as they are
+	for _, plain := range [][]byte{{}, []byte("short"), testData(chunkSize)} {
+		decrypted, err := decryptStream(plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(decrypted, plain) {
+			t.Errorf("A plain file of %d bytes was changed", len(plain))
+		}
+	}
+}
+
+func TestStreamWrongKey(t *testing.T) {
+	sealed := encryptStream(t, testData(10))
+
+	_, err := NewReader(bytes.NewReader(sealed), func(id uint) ([]byte, error) {
+		return nil, errors.New("Unknown key")
+	})
+	if err == nil {
+		t.Error("The stream was opened although its key is unknown")
+	}
+
+	r, err := NewReader(bytes.NewReader(sealed), func(id uint) ([]byte, error) {
+		return bytes.Repeat([]byte{2}, KeySize), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("The stream decrypted with a different key")
+	}
+}
+
+func TestStreamTruncated(t *testing.T) {
+	plain := testData(3*chunkSize + 17)
+	sealed := encryptStream(t, plain)
+
+	lastStart, _ := sealedChunk(3)
+	for name, length := range map[string]int{
+		"header only":          headerSize,
+		"partial header":       headerSize - 1,
+		"last chunk dropped":   lastStart,
+		"two chunks dropped":   lastStart - sealedChunkSize,
+		"last chunk cut short": lastStart + 10,
+		"one byte missing":     len(sealed) - 1,
+		"tag only":             lastStart + tagSize,
+	} {
+		decrypted, err := decryptStream(sealed[:length])
+		if err == nil {
+			t.Errorf("%s: %d bytes decrypted without error", name, len(decrypted))
+		}
+	}
+}
+
+func TestStreamEmptyTruncated(t *testing.T) {
+	// An empty file still has its final chunk
+	sealed := encryptStream(t, nil)
+	if len(sealed) != headerSize+tagSize {
+		t.Fatalf("An empty file encrypts to %d bytes", len(sealed))
+	}
+
+	if _, err := decryptStream(sealed[:headerSize]); err == nil {
+		t.Error("A stream without chunks was accepted")
+	}
+}
+
+func TestStreamReordered(t *testing.T) {
+	plain := testData(3*chunkSize + 17)
+	sealed := encryptStream(t, plain)
+
+	swapped := append([]byte{}, sealed...)
+	start0, end0 := sealedChunk(0)
+	start1, end1 := sealedChunk(1)
+	copy(swapped[start0:end0], sealed[start1:end1])
+	copy(swapped[start1:end1], sealed[start0:end0])
+
+	if _, err := decryptStream(swapped); err == nil {
+		t.Error("Swapped chunks were accepted")
+	}
+
+	// A full chunk moved to the end doesn't pass as the final one
+	start2, end2 := sealedChunk(2)
+	moved := append(append([]byte{}, sealed[:start2]...), sealed[start0:end0]...)
+	if _, err := decryptStream(moved); err == nil {
+		t.Error("A chunk moved to the end was accepted")
+	}
+
+	// Nor do chunks of another stream with the same key
+	other := encryptStream(t, plain)
+	mixed := append([]byte{}, sealed...)
+	copy(mixed[start2:end2], other[start2:end2])
+	if _, err := decryptStream(mixed); err == nil {
+		t.Error("A chunk of another stream was accepted")
+	}
+}
+
+func TestStreamTampered(t *testing.T) {
+	sealed := encryptStream(t, testData(2*chunkSize))
+
+	for _, offset := range []int{headerSize, headerSize + chunkSize, len(sealed) - 1} {
+		tampered := append([]byte{}, sealed...)
+		tampered[offset] ^= 1
+
+		if _, err := decryptStream(tampered); err == nil {
+			t.Errorf("A changed byte at %d was accepted", offset)
+		}
+	}
+}
+
+func TestStreamSeek(t *testing.T) {
+	plain := testData(3*chunkSize + 17)
+	sealed := encryptStream(t, plain)
+
+	r, err := NewReader(bytes.NewReader(sealed), testLookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil || size != int64(len(plain)) {
+		t.Fatalf("Seeking to the end returned %d, %v, want %d", size, err, len(plain))
+	}
+
+	read := func(length int) []byte {
+		buf := make([]byte, length)
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			t.Fatal(err)
+		}
+		return buf[:n]
+	}
+
+	for _, test := range []struct {
+		offset int64
+		whence int
+		pos    int
+		length int
+	}{
+		{0, io.SeekStart, 0, 10},
+		{chunkSize - 5, io.SeekStart, chunkSize - 5, 10},
+		{2 * chunkSize, io.SeekStart, 2 * chunkSize, chunkSize},
+		{-20, io.SeekEnd, len(plain) - 20, 20},
+		{-17, io.SeekEnd, 3 * chunkSize, 100},
+		{5, io.SeekStart, 5, 1},
+		{chunkSize, io.SeekCurrent, 6 + chunkSize, 3},
+		{-chunkSize, io.SeekCurrent, 9, 2 * chunkSize},
+	} {
+		pos, err := r.Seek(test.offset, test.whence)
+		if err != nil || pos != int64(test.pos) {
+			t.Fatalf("Seek(%d, %d) returned %d, %v, want %d", test.offset, test.whence, pos, err, test.pos)
+		}
+
+		end := test.pos + test.length
+		if end > len(plain) {
+			end = len(plain)
+		}
+
+		if got := read(test.length); !bytes.Equal(got, plain[test.pos:end]) {
+			t.Errorf("Reading %d bytes at %d returned different data", test.length, test.pos)
+		}
+	}
+
+	// Beyond the end there is nothing to read
+	if _, err := r.Seek(10, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := r.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Errorf("Reading beyond the end returned %d, %v", n, err)
+	}
+
+	if _, err := r.Seek(-1, io.SeekStart); err == nil {
+		t.Error("Seeking before the start succeeded")
+	}
+}
+
+func TestStreamSeekIntoTamperedChunk(t *testing.T) {
+	sealed := encryptStream(t, testData(3*chunkSize))
+
+	start, _ := sealedChunk(1)
+	sealed[start+100] ^= 1
+
+	r, err := NewReader(bytes.NewReader(sealed), testLookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The intact chunks are readable on their own
+	if _, err := r.Seek(2*chunkSize, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Errorf("Reading the last chunk failed: %s", err)
+	}
+
+	if _, err := r.Seek(chunkSize+10, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(make([]byte, 10)); err == nil {
+		t.Error("The tampered chunk was read")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/context"
+	"github.com/irrenhaus/pushmearound_server/httpresponse"
+	"github.com/irrenhaus/pushmearound_server/models"
+)
+
+const eventStreamKeepAlive = 30 * time.Second
+
+// EventStreamHandler keeps the connection open and pushes the users events as
+// Server-Sent Events
+func EventStreamHandler(resp http.ResponseWriter, req *http.Request) {
+	user, ok := context.Get(req, ContextKeyUser).(models.User)
+	if !ok {
+		httpresponse.InternalServerError("Could not convert user").WriteJSON(resp)
+		return
+	}
+
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		httpresponse.InternalServerError("Streaming not supported").WriteJSON(resp)
+		return
+	}
+
+	deviceID := req.FormValue("device")
+	if deviceID != "" {
+		device, err := models.FindDevice(DB, deviceID)
+		if err != nil || device.UserID != user.ID {
+			httpresponse.NotFound("No such device").WriteJSON(resp)
+			return
+		}
+	}
+
+	subscription := Events.Subscribe(user.ID, deviceID)
+	defer Events.Unsubscribe(subscription)
+
+	resp.Header().Set("Content-Type", "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Header().Set("Connection", "keep-alive")
+	resp.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventStreamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(resp, ": keep-alive\n\n")
+		case e := <-subscription.Events:
+			data, err := json.Marshal(e)
+			if err != nil {
+				log.WithFields(log.Fields{"user": user.ID, "event": e.Type, "error": err}).Error("Could not encode event")
+				continue
+			}
+
+			fmt.Fprintf(resp, "event: %s\ndata: %s\n\n", e.Type, data)
+		}
+
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,92 @@
+package events
+
+import (
+	"sync"
+)
+
+const (
+	TypeMessageRecalled  = "message_recalled"
+	TypeMessageDismissed = "message_dismissed"
+	TypeReadStateChanged = "read_state_changed"
+	TypeChecklistUpdated = "checklist_updated"
+	TypeClipboardChanged = "clipboard_changed"
+	TypePreviewReady     = "preview_ready"
+	TypeActionChosen     = "action_chosen"
+	TypeFlagsChanged     = "flags_changed"
+)
+
+// How many events may queue up for a slow subscriber before new ones are
+// dropped
+const subscriptionBuffer = 32
+
+type Event struct {
+	Type string
+	// OriginDeviceID is the device which caused the event. It will not be
+	// delivered back to that device.
+	OriginDeviceID string `json:"-"`
+	Data           interface{}
+}
+
+type Subscription struct {
+	UserID   uint
+	DeviceID string
+	Events   chan Event
+}
+
+// Broker fans out events to all connected streams of a user
+type Broker struct {
+	mutex         sync.RWMutex
+	subscriptions map[uint]map[*Subscription]bool
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		subscriptions: map[uint]map[*Subscription]bool{},
+	}
+}
+
+func (b *Broker) Subscribe(userID uint, deviceID string) *Subscription {
+	s := &Subscription{
+		UserID:   userID,
+		DeviceID: deviceID,
+		Events:   make(chan Event, subscriptionBuffer),
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.subscriptions[userID] == nil {
+		b.subscriptions[userID] = map[*Subscription]bool{}
+	}
+	b.subscriptions[userID][s] = true
+
+	return s
+}
+
+func (b *Broker) Unsubscribe(s *Subscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.subscriptions[s.UserID], s)
+	if len(b.subscriptions[s.UserID]) == 0 {
+		delete(b.subscriptions, s.UserID)
+	}
+}
+
+// Publish delivers the event to every stream of the user except the one of
+// the originating device. It never blocks; slow subscribers lose events.
+func (b *Broker) Publish(userID uint, e Event) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	for s := range b.subscriptions[userID] {
+		if e.OriginDeviceID != "" && s.DeviceID == e.OriginDeviceID {
+			continue
+		}
+
+		select {
+		case s.Events <- e:
+		default:
+		}
+	}
+}
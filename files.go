@@ -0,0 +1,390 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/irrenhaus/pushmearound_server/encryption"
+	"github.com/irrenhaus/pushmearound_server/httpresponse"
+	"github.com/irrenhaus/pushmearound_server/models"
+	"github.com/irrenhaus/pushmearound_server/storage"
+)
+
+// http.DetectContentType looks at no more than this many bytes
+const sniffLength = 512
+
+// detectMIMEType sniffs the type from the start of the file. If that only
+// yields a generic type the file extension is consulted.
+func detectMIMEType(head []byte, fileName string) string {
+	sniffed := http.DetectContentType(head)
+
+	if sniffed == "application/octet-stream" || strings.HasPrefix(sniffed, "text/plain") {
+		if byExtension := mime.TypeByExtension(filepath.Ext(fileName)); byExtension != "" {
+			return byExtension
+		}
+	}
+
+	return sniffed
+}
+
+var errUploadTooLarge = errors.New("Upload too large")
+
+// uploadLimitReader fails with errUploadTooLarge as soon as more than the
+// allowed number of bytes has been read
+type uploadLimitReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func newUploadLimitReader(r io.Reader, limit int64) *uploadLimitReader {
+	return &uploadLimitReader{r: r, remaining: limit}
+}
+
+func (l *uploadLimitReader) Read(p []byte) (int, error) {
+	// Read one byte more than allowed to find out whether there is more
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, errUploadTooLarge
+	}
+
+	return n, err
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// putBlob stores a file, encrypted with the users data key if encryption at
+// rest is enabled. It returns the size of the unencrypted file.
+func putBlob(userID uint, key string, src io.Reader) (int64, error) {
+	counter := &countingReader{r: src}
+
+	var r io.Reader = counter
+	if MasterKey != nil {
+		dataKey, err := userDataKey(userID)
+		if err != nil {
+			return 0, err
+		}
+
+		if r, err = encryption.NewEncryptReader(dataKey, counter); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := BlobStorage.Put(key, r); err != nil {
+		return 0, err
+	}
+
+	return counter.n, nil
+}
+
+type decryptedBlob struct {
+	io.ReadSeeker
+	io.Closer
+}
+
+// openBlob opens a stored file for reading. Encrypted files are decrypted on
+// the fly, files stored before encryption was enabled are read as they are.
+func openBlob(key string) (storage.Blob, error) {
+	blob, err := BlobStorage.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := encryption.NewReader(blob, dataKey)
+	if err != nil {
+		blob.Close()
+		return nil, err
+	}
+
+	return decryptedBlob{r, blob}, nil
+}
+
+// storeUpload puts the uploaded file into the blob storage while collecting
+// its size, hash and MIME type
+func storeUpload(userID uint, key string, src io.Reader, fileName string) (*models.Attachment, error) {
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	hash := sha256.New()
+	size, err := putBlob(userID, key, io.TeeReader(io.MultiReader(bytes.NewReader(head), src), hash))
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.Attachment{
+		File:     key,
+		FileName: fileName,
+		MimeType: detectMIMEType(head, fileName),
+		Size:     size,
+		SHA256:   hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+// deleteUpload removes a stored upload, if any. Failures are only logged as
+// there is nothing the client could do about them.
+func deleteUpload(key string) {
+	if key == "" {
+		return
+	}
+
+	if err := BlobStorage.Delete(key); err != nil && err != storage.ErrNotFound {
+		log.WithFields(log.Fields{"file": key, "error": err}).Warn("Could not delete uploaded file")
+	}
+}
+
+// claimAttachment registers a reference to the attachments file. If a file with
+// the same content is stored already, the attachment is switched over to it
+// and the key of the now redundant copy returned. The caller deletes it once
+// it is sure the copy isn't needed anymore.
+func claimAttachment(attachment *models.Attachment) (string, error) {
+	blob, err := models.AcquireBlob(DB, attachment.SHA256, attachment.File, attachment.Size)
+	if err != nil {
+		return "", err
+	}
+
+	redundant := ""
+	if blob.File != attachment.File {
+		redundant = attachment.File
+		attachment.File = blob.File
+	}
+
+	// The last reference to a reused file might have been released in the
+	// meantime, together with the file itself
+	if _, err := BlobStorage.Stat(attachment.File); err != nil {
+		releaseUpload(attachment.File)
+		if redundant != "" {
+			attachment.File = redundant
+		}
+		return "", err
+	}
+
+	return redundant, nil
+}
+
+// claimExistingAttachment registers another reference to a file sent before.
+// It fails if the file has been released meanwhile.
+func claimExistingAttachment(attachment *models.Attachment) error {
+	if _, err := models.AcquireExistingBlob(DB, attachment.File); err != nil {
+		return err
+	}
+
+	if _, err := BlobStorage.Stat(attachment.File); err != nil {
+		releaseUpload(attachment.File)
+		return err
+	}
+
+	return nil
+}
+
+// releaseUpload drops a reference to a stored file and deletes the file once
+// nothing refers to it anymore
+func releaseUpload(key string) {
+	if key == "" {
+		return
+	}
+
+	last, err := models.ReleaseBlob(DB, key)
+	if err != nil {
+		log.WithFields(log.Fields{"file": key, "error": err}).Error("SQL error while releasing file")
+		return
+	}
+
+	if last {
+		deleteUpload(key)
+		deleteThumbnails(key)
+	}
+}
+
+// BlobExistsHandler lets clients check whether they sent a file before. If so
+// it can be sent again by passing its hash instead of uploading it. Only the
+// users own files are considered so that nobody can probe for the files of
+// other users, even though the stored files are shared between all users.
+func BlobExistsHandler(resp http.ResponseWriter, req *http.Request) {
+	user, ok := context.Get(req, ContextKeyUser).(models.User)
+	if !ok {
+		httpresponse.InternalServerError("Could not convert user").WriteJSON(resp)
+		return
+	}
+
+	vars := mux.Vars(req)
+	hash := strings.ToLower(vars["sha256"])
+
+	attachment, err := models.FindUserAttachmentBySHA256(DB, user.ID, hash)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.WithFields(log.Fields{"user": user.ID, "sha256": hash, "error": err}).Error("SQL error while finding attachment by hash")
+		}
+
+		httpresponse.NotFound("Unknown file").WriteJSON(resp)
+		return
+	}
+
+	response := httpresponse.Success("")
+	response.Data = map[string]interface{}{
+		"sha256": attachment.SHA256,
+		"size":   attachment.Size,
+	}
+	response.WriteJSON(resp)
+}
+
+// FileDownloadHandler streams an uploaded file to a user which received the
+// message it belongs to. Range requests are handled by http.ServeContent.
+func FileDownloadHandler(resp http.ResponseWriter, req *http.Request) {
+	user, ok := context.Get(req, ContextKeyUser).(models.User)
+	if !ok {
+		httpresponse.InternalServerError("Could not convert user").WriteJSON(resp)
+		return
+	}
+
+	vars := mux.Vars(req)
+	fileID := vars["id"]
+
+	attachment, err := models.FindReceivedAttachment(DB, user.ID, fileID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.WithFields(log.Fields{"user": user.ID, "file": fileID, "error": err}).Error("SQL error while finding attachment")
+		}
+
+		httpresponse.NotFound("No such file").WriteJSON(resp)
+		return
+	}
+
+	info, err := BlobStorage.Stat(attachment.File)
+	if err != nil {
+		log.WithFields(log.Fields{"msg": attachment.MessageID, "file": attachment.File, "error": err}).Error("Could not stat uploaded file")
+		httpresponse.NotFound("No such file").WriteJSON(resp)
+		return
+	}
+
+	blob, err := openBlob(attachment.File)
+	if err != nil {
+		log.WithFields(log.Fields{"msg": attachment.MessageID, "file": attachment.File, "error": err}).Error("Could not open uploaded file")
+		httpresponse.NotFound("No such file").WriteJSON(resp)
+		return
+	}
+	defer blob.Close()
+
+	// Uploads never change, so the file ID makes a fine strong ETag
+	resp.Header().Set("ETag", fmt.Sprintf(`"%s"`, attachment.File))
+	resp.Header().Set("Content-Type", attachment.MimeType)
+	resp.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.FileName}))
+
+	http.ServeContent(resp, req, attachment.FileName, info.ModTime, blob)
+}
+
+// archiveName returns a name for the file which is not used in the archive
+// yet
+func archiveName(used map[string]bool, fileName string) string {
+	fileName = filepath.Base(strings.Replace(fileName, "\\", "/", -1))
+	if fileName == "." || fileName == "/" {
+		fileName = "file"
+	}
+
+	name := fileName
+	ext := filepath.Ext(fileName)
+	for i := 2; used[name]; i++ {
+		name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(fileName, ext), i, ext)
+	}
+	used[name] = true
+
+	return name
+}
+
+// MessageArchiveHandler streams all attachments of a message as a ZIP
+// archive. The archive is built on the fly, so neither Content-Length nor
+// Range requests are supported.
+func MessageArchiveHandler(resp http.ResponseWriter, req *http.Request) {
+	user, ok := context.Get(req, ContextKeyUser).(models.User)
+	if !ok {
+		httpresponse.InternalServerError("Could not convert user").WriteJSON(resp)
+		return
+	}
+
+	vars := mux.Vars(req)
+	msgID, err := strconv.ParseUint(vars["msg"], 10, 32)
+	if err != nil {
+		httpresponse.BadRequest("Invalid message ID").WriteJSON(resp)
+		return
+	}
+
+	attachments, err := models.FindReceivedMessageAttachments(DB, user.ID, uint(msgID))
+	if err != nil {
+		log.WithFields(log.Fields{"user": user.ID, "msg": msgID, "error": err}).Error("SQL error while finding attachments")
+		httpresponse.InternalServerError("Could not load attachments").WriteJSON(resp)
+		return
+	}
+
+	if len(attachments) == 0 {
+		httpresponse.NotFound("No such message").WriteJSON(resp)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/zip")
+	resp.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fmt.Sprintf("message-%d.zip", msgID)}))
+
+	// Once the first byte is written there is no way to report an error to
+	// the client other than aborting the archive
+	archive := zip.NewWriter(resp)
+	used := map[string]bool{}
+
+	for _, attachment := range attachments {
+		blob, err := openBlob(attachment.File)
+		if err != nil {
+			log.WithFields(log.Fields{"msg": msgID, "file": attachment.File, "error": err}).Error("Could not open uploaded file")
+			return
+		}
+
+		header := &zip.FileHeader{
+			Name:   archiveName(used, attachment.FileName),
+			Method: zip.Deflate,
+		}
+		header.SetModTime(attachment.CreatedAt)
+
+		w, err := archive.CreateHeader(header)
+		if err == nil {
+			_, err = io.Copy(w, blob)
+		}
+		blob.Close()
+
+		if err != nil {
+			log.WithFields(log.Fields{"msg": msgID, "file": attachment.File, "error": err}).Warn("Could not write file to archive")
+			return
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		log.WithFields(log.Fields{"msg": msgID, "error": err}).Warn("Could not finish archive")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/irrenhaus/pushmearound_server/events"
+	"github.com/irrenhaus/pushmearound_server/httpresponse"
+	"github.com/irrenhaus/pushmearound_server/models"
+)
+
+// parseOptionalBool reads a boolean form value, nil if it isn't given
+func parseOptionalBool(req *http.Request, name string) (*bool, error) {
+	value := req.FormValue(name)
+	if value == "" {
+		return nil, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s has to be a boolean", name)
+	}
+
+	return &b, nil
+}
+
+// MessageFlagsHandler stars, pins or archives a message. Only the given
+// flags are changed, all other devices of the user are notified.
+func MessageFlagsHandler(resp http.ResponseWriter, req *http.Request) {
+	user, ok := context.Get(req, ContextKeyUser).(models.User)
+	if !ok {
+		httpresponse.InternalServerError("Could not convert user").WriteJSON(resp)
+		return
+	}
+
+	vars := mux.Vars(req)
+	msgID, err := strconv.ParseUint(vars["msg"], 10, 32)
+	if err != nil {
+		httpresponse.BadRequest("Invalid message ID").WriteJSON(resp)
+		return
+	}
+
+	update := models.MessageFlagsUpdate{}
+	if update.Starred, err = parseOptionalBool(req, "starred"); err != nil {
+		httpresponse.BadRequest(err.Error()).WriteJSON(resp)
+		return
+	}
+	if update.Pinned, err = parseOptionalBool(req, "pinned"); err != nil {
+		httpresponse.BadRequest(err.Error()).WriteJSON(resp)
+		return
+	}
+	if update.Archived, err = parseOptionalBool(req, "archived"); err != nil {
+		httpresponse.BadRequest(err.Error()).WriteJSON(resp)
+		return
+	}
+
+	if update.Starred == nil && update.Pinned == nil && update.Archived == nil {
+		httpresponse.BadRequest("Nothing to update, set starred, pinned or archived").WriteJSON(resp)
+		return
+	}
+
+	flags, err := models.UpdateMessageFlags(DB, user.ID, uint(msgID), update)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.WithFields(log.Fields{"user": user.ID, "msg": msgID, "error": err}).Error("SQL error while updating message flags")
+			httpresponse.InternalServerError("Updating the message failed").WriteJSON(resp)
+			return
+		}
+
+		httpresponse.NotFound("No such message").WriteJSON(resp)
+		return
+	}
+
+	data := map[string]interface{}{
+		"message_id": uint(msgID),
+		"starred":    flags.Starred,
+		"pinned":     flags.Pinned,
+		"archived":   flags.Archived,
+	}
+
+	Events.Publish(user.ID, events.Event{
+		Type:           events.TypeFlagsChanged,
+		OriginDeviceID: req.FormValue("device"),
+		Data:           data,
+	})
+
+	response := httpresponse.Success("")
+	response.Data = data
+	response.WriteJSON(resp)
+}
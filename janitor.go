@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/irrenhaus/pushmearound_server/events"
+	"github.com/irrenhaus/pushmearound_server/models"
+	"github.com/irrenhaus/pushmearound_server/storage"
+)
+
+// Files younger than this are never considered orphaned, they might belong to
+// a send request which is still in progress
+const orphanGracePeriod = time.Hour
+
+type janitorReport struct {
+	ExpiredMessages map[string][]models.Message
+	OrphanedFiles   []storage.Info
+}
+
+// parseRetention parses a list like "message=365d,file=30d" into the number
+// of days messages of each content type are kept. Messages only record the day
+// they were created on, so nothing shorter than a day can be given. Content
+// types which are not listed are kept forever.
+func parseRetention(value string) (map[uint]uint, error) {
+	contentTypes := map[string]uint{}
+	for contentType, name := range models.ContentTypeNames {
+		contentTypes[name] = contentType
+	}
+
+	retentions := map[uint]uint{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		fields := strings.SplitN(entry, "=", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid retention entry: %s", entry)
+		}
+
+		contentType, ok := contentTypes[fields[0]]
+		if !ok {
+			return nil, fmt.Errorf("Unknown content type: %s", fields[0])
+		}
+
+		if !strings.HasSuffix(fields[1], "d") {
+			return nil, fmt.Errorf("Retention durations have to be given in days: %s", fields[1])
+		}
+
+		days, err := strconv.ParseUint(strings.TrimSuffix(fields[1], "d"), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid retention duration: %s", fields[1])
+		}
+
+		if days == 0 {
+			return nil, errors.New("Retention durations have to be positive")
+		}
+
+		retentions[contentType] = uint(days)
+	}
+
+	return retentions, nil
+}
+
+// cleanUp deletes expired messages and orphaned files. In dry run mode nothing
+// is deleted, the report only lists what would have been.
+func cleanUp(dryRun bool) (janitorReport, error) {
+	report := janitorReport{
+		ExpiredMessages: map[string][]models.Message{},
+		OrphanedFiles:   []storage.Info{},
+	}
+
+	retentions, err := parseRetention(*retention)
+	if err != nil {
+		return report, err
+	}
+
+	for contentType, days := range retentions {
+		msgs, err := models.FindMessagesOlderThan(DB, contentType, days)
+		if err != nil {
+			return report, err
+		}
+
+		name := models.ContentTypeNames[contentType]
+		report.ExpiredMessages[name] = msgs
+
+		if dryRun {
+			continue
+		}
+
+		for _, msg := range msgs {
+			if err := msg.Recall(DB); err != nil {
+				log.WithFields(log.Fields{"msg": msg.ID, "error": err}).Error("Could not delete expired message")
+				continue
+			}
+
+			if len(msg.Attachments) > 0 {
+				releaseAttachments(msg.Attachments)
+				updateStorageUsage(msg.UserID)
+			}
+
+			Events.Publish(msg.UserID, events.Event{
+				Type: events.TypeMessageRecalled,
+				Data: map[string]uint{
+					"message_id": msg.ID,
+				},
+			})
+		}
+	}
+
+	referenced, err := models.FindReferencedFiles(DB)
+	if err != nil {
+		return report, err
+	}
+
+	graceLimit := time.Now().Add(-orphanGracePeriod)
+	err = BlobStorage.Walk(func(info storage.Info) error {
+		if referenced[info.Key] || info.ModTime.After(graceLimit) {
+			return nil
+		}
+
+		// Quarantined files are kept for inspection, they are removed with
+		// their message or by hand
+		if isQuarantined(info.Key) {
+			return nil
+		}
+
+		// Thumbnails live as long as the file they were made from
+		if base, ok := thumbnailBase(info.Key); ok && referenced[base] {
+			return nil
+		}
+
+		report.OrphanedFiles = append(report.OrphanedFiles, info)
+		if !dryRun {
+			deleteUpload(info.Key)
+		}
+
+		return nil
+	})
+
+	return report, err
+}
+
+// runJanitor cleans up periodically in the background
+func runJanitor() {
+	if *janitorInterval <= 0 {
+		return
+	}
+
+	for range time.Tick(*janitorInterval) {
+		report, err := cleanUp(false)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Janitor failed")
+			continue
+		}
+
+		expired := 0
+		for _, msgs := range report.ExpiredMessages {
+			expired += len(msgs)
+		}
+
+		log.WithFields(log.Fields{"messages": expired, "files": len(report.OrphanedFiles)}).Info("Janitor deleted expired messages and orphaned files")
+	}
+}
+
+// janitorCommand runs the janitor once from the command line and prints a
+// report
+func janitorCommand(args []string) {
+	flags := flag.NewFlagSet("janitor", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "Only report what would be deleted")
+	flags.Parse(args)
+
+	report, err := cleanUp(*dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	action := "Deleted"
+	if *dryRun {
+		action = "Would delete"
+	}
+
+	for name, msgs := range report.ExpiredMessages {
+		fmt.Fprintf(os.Stdout, "%s %d expired %s messages\n", action, len(msgs), name)
+		for _, msg := range msgs {
+			fmt.Fprintf(os.Stdout, "  message %d of user %d from %s\n", msg.ID, msg.UserID, msg.CreatedAt.Format("2006-01-02"))
+		}
+	}
+
+	var orphanedBytes int64
+	for _, info := range report.OrphanedFiles {
+		orphanedBytes += info.Size
+	}
+
+	fmt.Fprintf(os.Stdout, "%s %d orphaned files (%d bytes)\n", action, len(report.OrphanedFiles), orphanedBytes)
+	for _, info := range report.OrphanedFiles {
+		fmt.Fprintf(os.Stdout, "  %s (%d bytes, %s)\n", info.Key, info.Size, info.ModTime.Format(time.RFC3339))
+	}
+}
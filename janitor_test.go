@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/irrenhaus/pushmearound_server/models"
+)
+
+func TestParseRetention(t *testing.T) {
+	retentions, err := parseRetention("message=365d, file=30d,")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(retentions) != 2 || retentions[models.ContentTypeMessage] != 365 || retentions[models.ContentTypeFile] != 30 {
+		t.Errorf("Parsed %v", retentions)
+	}
+}
+
+func TestParseRetentionRejectsPartialDays(t *testing.T) {
+	for _, value := range []string{
+		"message=12h",
+		"message=36h",
+		"message=1.5d",
+		"message=0d",
+		"message=-1d",
+		"message=d",
+		"message",
+		"unknown=1d",
+	} {
+		if _, err := parseRetention(value); err == nil {
+			t.Errorf("parseRetention accepted %s", value)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/irrenhaus/pushmearound_server/encryption"
+	"github.com/irrenhaus/pushmearound_server/models"
+)
+
+// MasterKey wraps the data keys. Without one nothing is encrypted at rest.
+var MasterKey *encryption.Master
+
+var errNoMasterKey = errors.New("Encrypted data found but no master key configured")
+
+// Unwrapped data keys, by ID and by user
+var dataKeys = struct {
+	sync.Mutex
+	byID   map[uint][]byte
+	byUser map[uint]encryption.Key
+}{
+	byID:   map[uint][]byte{},
+	byUser: map[uint]encryption.Key{},
+}
+
+func loadMasterKey(path string) (*encryption.Master, error) {
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return encryption.ParseMaster(string(encoded))
+}
+
+// setupEncryption loads the master key, if configured. Stored data is
+// decrypted either way so that encrypted data is never handed out as is.
+func setupEncryption() {
+	models.Sealer = fieldSealer{}
+
+	if *masterKeyFile == "" {
+		return
+	}
+
+	var err error
+	MasterKey, err = loadMasterKey(*masterKeyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// dataKey returns the unwrapped data key with the given ID
+func dataKey(id uint) ([]byte, error) {
+	if MasterKey == nil {
+		return nil, errNoMasterKey
+	}
+
+	dataKeys.Lock()
+	defer dataKeys.Unlock()
+
+	if key, ok := dataKeys.byID[id]; ok {
+		return key, nil
+	}
+
+	stored, err := models.FindDataKey(DB, id)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := unwrapDataKey(stored)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKeys.byID[id] = key
+	return key, nil
+}
+
+// userDataKey returns the key new data of the user is encrypted with. Users
+// get their key when they store something for the first time.
+func userDataKey(userID uint) (encryption.Key, error) {
+	dataKeys.Lock()
+	defer dataKeys.Unlock()
+
+	if key, ok := dataKeys.byUser[userID]; ok {
+		return key, nil
+	}
+
+	stored, err := models.FindUserDataKey(DB, userID)
+	if err != nil && err != sql.ErrNoRows {
+		return encryption.Key{}, err
+	}
+
+	var key []byte
+	if err == sql.ErrNoRows {
+		key, stored.WrappedKey, err = MasterKey.NewDataKey()
+		if err != nil {
+			return encryption.Key{}, err
+		}
+
+		stored.UserID = userID
+		stored.MasterKeyID = MasterKey.ID()
+		if err := stored.Create(DB); err != nil {
+			return encryption.Key{}, err
+		}
+	} else if key, err = unwrapDataKey(stored); err != nil {
+		return encryption.Key{}, err
+	}
+
+	dataKeys.byID[stored.ID] = key
+	dataKeys.byUser[userID] = encryption.Key{ID: stored.ID, Key: key}
+	return dataKeys.byUser[userID], nil
+}
+
+func unwrapDataKey(stored models.DataKey) ([]byte, error) {
+	if stored.MasterKeyID != MasterKey.ID() {
+		return nil, fmt.Errorf("Data key %d is wrapped with unknown master key %s", stored.ID, stored.MasterKeyID)
+	}
+
+	return MasterKey.Unwrap(stored.WrappedKey)
+}
+
+// fieldSealer encrypts message contents with the data key of their owner
+type fieldSealer struct{}
+
+func (fieldSealer) Enabled() bool {
+	return MasterKey != nil
+}
+
+func (fieldSealer) Seal(userID uint, value string) (string, error) {
+	if MasterKey == nil {
+		return "", errNoMasterKey
+	}
+
+	key, err := userDataKey(userID)
+	if err != nil {
+		return "", err
+	}
+
+	return encryption.Seal(key, value)
+}
+
+func (fieldSealer) Open(value string) (string, error) {
+	return encryption.Open(dataKey, value)
+}
+
+// rotateMasterKeyCommand rewraps all data keys with a new master key. Data
+// keys already wrapped with the new key are skipped, so an interrupted
+// rotation can simply be run again. Afterwards -master-key-file has to point
+// to the new key.
+func rotateMasterKeyCommand(args []string) {
+	flags := flag.NewFlagSet("rotate-master-key", flag.ExitOnError)
+	newKeyFile := flags.String("new-key-file", "", "File with the new base64 encoded master key")
+	flags.Parse(args)
+
+	if MasterKey == nil {
+		log.Fatal("The current master key has to be given with -master-key-file")
+	}
+
+	if *newKeyFile == "" {
+		log.Fatal("No new master key given")
+	}
+
+	newMaster, err := loadMasterKey(*newKeyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if newMaster.ID() == MasterKey.ID() {
+		log.Fatal("The new master key is the current one")
+	}
+
+	keys, err := models.FindDataKeysNotWrappedWith(DB, newMaster.ID())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, stored := range keys {
+		key, err := unwrapDataKey(stored)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if stored.WrappedKey, err = newMaster.Wrap(key); err != nil {
+			log.Fatal(err)
+		}
+
+		stored.MasterKeyID = newMaster.ID()
+		if err := stored.Update(DB); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	fmt.Fprintf(os.Stdout, "Rewrapped %d data keys with master key %s\n", len(keys), newMaster.ID())
+}
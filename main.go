@@ -3,8 +3,11 @@ package main
 import (
 	"crypto/rsa"
 	"database/sql"
+	"flag"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/codegangsta/negroni"
@@ -12,6 +15,9 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
+	"github.com/irrenhaus/pushmearound_server/events"
+	"github.com/irrenhaus/pushmearound_server/scanner"
+	"github.com/irrenhaus/pushmearound_server/storage"
 	_ "github.com/lib/pq"
 	_ "github.com/mattes/migrate/driver/postgres"
 	"github.com/mattes/migrate/migrate"
@@ -29,6 +35,34 @@ var (
 
 var SessionStore *sessions.CookieStore
 var DB *sql.DB
+var Events = events.NewBroker()
+var BlobStorage storage.Storage
+var UploadScanner scanner.Scanner
+
+var (
+	storageDriver = flag.String("storage", "local", "Blob storage driver for uploads: local, memory or s3")
+	storageRoot   = flag.String("storage-root", "./upload", "Directory the local storage driver keeps uploads in")
+	s3Endpoint    = flag.String("s3-endpoint", "", "URL of the S3 compatible endpoint, e.g. http://localhost:9000")
+	s3Region      = flag.String("s3-region", "us-east-1", "S3 region")
+	s3Bucket      = flag.String("s3-bucket", "pushmearound", "S3 bucket uploads are stored in")
+	uploadStaging = flag.String("upload-staging", "./staging", "Directory unfinished resumable uploads are kept in")
+	maxUploadSize = flag.Int64("max-upload-size", 1024*1024*1024, "Maximum size of a single upload in bytes")
+	masterKeyFile = flag.String("master-key-file", "", "File with the base64 encoded 32 byte master key for encryption at rest, empty to disable")
+
+	scannerDriver = flag.String("scanner", "", "Scanner uploads are checked with before delivery: clamd, or empty to disable")
+	clamdAddress  = flag.String("clamd-address", "localhost:3310", "Address of clamd, host:port or unix:/path/to/clamd.sock")
+	clamdTimeout  = flag.Duration("clamd-timeout", 2*time.Minute, "Maximum time a single scan may take")
+
+	unfurlEnabled = flag.Bool("unfurl", true, "Fetch link previews for URL messages")
+	unfurlTimeout = flag.Duration("unfurl-timeout", 5*time.Second, "Maximum time fetching a single link preview may take")
+	unfurlMaxSize = flag.Int64("unfurl-max-size", 512*1024, "Maximum number of bytes read from a page for its link preview")
+
+	callbackTimeout = flag.Duration("callback-timeout", 10*time.Second, "Maximum time posting a single action callback may take")
+
+	retention        = flag.String("retention", "message=365d,url=365d,file=30d,encrypted=365d", "How many days messages are kept, per content type")
+	clipboardHistory = flag.Uint("clipboard-history", 10, "How many clipboard entries are kept per user")
+	janitorInterval  = flag.Duration("janitor-interval", 6*time.Hour, "How often expired messages and orphaned files are deleted, 0 to disable")
+)
 
 func setupSessions() {
 	// Use a 32 byte key to select AES-256
@@ -62,9 +96,55 @@ func setupSessions() {
 	}
 }
 
-func main() {
-	setupSessions()
+// setupStorage creates the configured blob storage driver. The S3 credentials
+// are taken from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+func setupStorage() {
+	var err error
+
+	switch *storageDriver {
+	case "local":
+		BlobStorage, err = storage.NewLocal(*storageRoot)
+	case "memory":
+		BlobStorage = storage.NewMemory()
+	case "s3":
+		BlobStorage, err = storage.NewS3(storage.S3Config{
+			Endpoint:  *s3Endpoint,
+			Region:    *s3Region,
+			Bucket:    *s3Bucket,
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		})
+	default:
+		log.Fatalf("Unknown storage driver: %s", *storageDriver)
+	}
 
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := os.MkdirAll(*uploadStaging, 0755); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// setupScanner creates the configured upload scanner, if any
+func setupScanner() {
+	var err error
+
+	switch *scannerDriver {
+	case "":
+	case "clamd":
+		UploadScanner, err = scanner.NewClamd(*clamdAddress, *clamdTimeout)
+	default:
+		log.Fatalf("Unknown scanner: %s", *scannerDriver)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func setupDatabase() {
 	allErrors, ok := migrate.UpSync("postgres://localhost/pushmearound?user=pushmearound&sslmode=disable&password=pushmearound", "./migrations")
 	if !ok {
 		for _, e := range allErrors {
@@ -78,6 +158,42 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+}
+
+func main() {
+	flag.Parse()
+
+	if _, err := parseRetention(*retention); err != nil {
+		log.Fatal(err)
+	}
+
+	setupStorage()
+	setupScanner()
+	setupUnfurl()
+	setupCallbacks()
+	setupDatabase()
+	setupEncryption()
+
+	// Subcommands
+	switch flag.Arg(0) {
+	case "":
+	case "janitor":
+		janitorCommand(flag.Args()[1:])
+		return
+	case "rotate-master-key":
+		rotateMasterKeyCommand(flag.Args()[1:])
+		return
+	default:
+		log.Fatalf("Unknown command: %s", flag.Arg(0))
+	}
+
+	setupSessions()
+
+	go expireUploads()
+	go runJanitor()
+	go runThumbnailer()
+	go runUnfurler()
+	go runCallbacks()
 
 	r := mux.NewRouter()
 	r.Handle("/", http.FileServer(http.Dir("./static")))
@@ -90,15 +206,50 @@ func main() {
 	onlyPOSTRouter := r.Methods("POST").Subrouter()
 	onlyPOSTRouter.HandleFunc("/device/create", MustAuthenticateWrapper(DeviceCreateHandler))
 	onlyPOSTRouter.HandleFunc("/device/options", MustAuthenticateWrapper(DeviceOptionsHandler))
+	onlyPOSTRouter.HandleFunc("/device/key", MustAuthenticateWrapper(DeviceKeyHandler))
+	onlyPOSTRouter.HandleFunc("/msg/read", MustAuthenticateWrapper(MarkReadListHandler))
+	onlyPOSTRouter.HandleFunc("/msg/read/all", MustAuthenticateWrapper(MarkAllReadHandler))
+	onlyPOSTRouter.HandleFunc("/msg/read/upto/{msg:[0-9]+}", MustAuthenticateWrapper(MarkReadUpToHandler))
+	onlyPOSTRouter.HandleFunc("/msg/{msg:[0-9]+}/dismiss", MustAuthenticateWrapper(DismissMessageHandler))
+	onlyPOSTRouter.HandleFunc("/msg/{msg:[0-9]+}/action", MustAuthenticateWrapper(MessageActionHandler))
+	onlyPOSTRouter.HandleFunc("/uploads", MustAuthenticateWrapper(TusCreateHandler))
 
-	// Sending messages needs to happen as multipart/form-data
-	onlyPOSTRouter.Headers("Content-Type", "multipart/form-data").Subrouter().HandleFunc("/msg/send", MustAuthenticateWrapper(SendMessageHandler))
+	// Sending messages needs to happen as multipart/form-data, the handler
+	// rejects everything else
+	onlyPOSTRouter.HandleFunc("/msg/send", MustAuthenticateWrapper(SendMessageHandler))
 
 	onlyGETRouter := r.Methods("GET").Subrouter()
+	onlyGETRouter.HandleFunc("/device/keys", MustAuthenticateWrapper(DeviceKeysHandler))
+	onlyGETRouter.HandleFunc("/schemas/{type}", PayloadSchemaHandler)
 	onlyGETRouter.HandleFunc("/msg/unread", MustAuthenticateWrapper(UnreadMessageHandler))
+	onlyGETRouter.HandleFunc("/msg/history", MustAuthenticateWrapper(HistoryMessageHandler))
+	onlyGETRouter.HandleFunc("/msg/search", MustAuthenticateWrapper(SearchMessageHandler))
+	onlyGETRouter.HandleFunc("/clipboard", MustAuthenticateWrapper(ClipboardHandler))
+	onlyGETRouter.HandleFunc("/events", MustAuthenticateWrapper(EventStreamHandler))
+	onlyGETRouter.HandleFunc("/account/usage", MustAuthenticateWrapper(AccountUsageHandler))
+	onlyGETRouter.HandleFunc("/msg/{msg}/attachments.zip", MustAuthenticateWrapper(MessageArchiveHandler))
+	onlyGETRouter.HandleFunc("/msg/{msg:[0-9]+}/thread", MustAuthenticateWrapper(ThreadMessageHandler))
+	onlyGETRouter.HandleFunc("/files/{id}", MustAuthenticateWrapper(FileDownloadHandler))
+	onlyGETRouter.HandleFunc("/files/{id}/thumbnail", MustAuthenticateWrapper(ThumbnailHandler))
+	onlyGETRouter.HandleFunc("/blobs/{sha256:[0-9a-fA-F]{64}}", MustAuthenticateWrapper(BlobExistsHandler))
 
 	onlyPUTRouter := r.Methods("PUT").Subrouter()
 	onlyPUTRouter.HandleFunc("/msg/{msg:[0-9]+}", MustAuthenticateWrapper(UpdateMessageHandler))
+	onlyPUTRouter.HandleFunc("/msg/{msg:[0-9]+}/checklist/{item:[0-9]+}", MustAuthenticateWrapper(ChecklistItemHandler))
+	onlyPUTRouter.HandleFunc("/msg/{msg:[0-9]+}/flags", MustAuthenticateWrapper(MessageFlagsHandler))
+
+	onlyDELETERouter := r.Methods("DELETE").Subrouter()
+	onlyDELETERouter.HandleFunc("/msg/{msg:[0-9]+}", MustAuthenticateWrapper(DeleteMessageHandler))
+	onlyDELETERouter.HandleFunc("/uploads/{id}", MustAuthenticateWrapper(TusDeleteHandler))
+
+	onlyHEADRouter := r.Methods("HEAD").Subrouter()
+	onlyHEADRouter.HandleFunc("/uploads/{id}", MustAuthenticateWrapper(TusHeadHandler))
+
+	onlyPATCHRouter := r.Methods("PATCH").Subrouter()
+	onlyPATCHRouter.HandleFunc("/uploads/{id}", MustAuthenticateWrapper(TusPatchHandler))
+
+	onlyOPTIONSRouter := r.Methods("OPTIONS").Subrouter()
+	onlyOPTIONSRouter.HandleFunc("/uploads", TusOptionsHandler)
 
 	n := negroni.Classic()
 	n.Use(negroni.HandlerFunc(AuthMiddleware))
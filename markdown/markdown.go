@@ -0,0 +1,31 @@
+package markdown
+
+import (
+	"bytes"
+	"regexp"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+)
+
+// The CommonMark renderer escapes raw HTML already, the sanitizer is the
+// safety net for everything the renderer lets through
+var renderer = goldmark.New()
+
+// Links may only point to the web or to mail addresses. Code blocks keep their
+// language so clients can highlight them.
+var policy = bluemonday.UGCPolicy().
+	AllowURLSchemes("http", "https", "mailto").
+	RequireNoFollowOnLinks(true).
+	AddTargetBlankToFullyQualifiedLinks(true).
+	AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w-]+$`)).OnElements("code")
+
+// Render converts CommonMark to HTML which is safe to embed in a page
+func Render(source string) (string, error) {
+	var buf bytes.Buffer
+	if err := renderer.Convert([]byte(source), &buf); err != nil {
+		return "", err
+	}
+
+	return string(policy.SanitizeBytes(buf.Bytes())), nil
+}
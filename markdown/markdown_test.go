@@ -0,0 +1,89 @@
+package markdown
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	for source, want := range map[string]string{
+		"**bold** and _em_":                  "<p><strong>bold</strong> and <em>em</em></p>",
+		"```go\nfmt.Println()\n```":          `<pre><code class="language-go">fmt.Println()`,
+		"[site](https://example.com/)":       `href="https://example.com/"`,
+		"[mail](mailto:someone@example.com)": `href="mailto:someone@example.com"`,
+	} {
+		html, err := Render(source)
+		if err != nil {
+			t.Errorf("Rendering %q failed: %s", source, err)
+			continue
+		}
+
+		if !strings.Contains(html, want) {
+			t.Errorf("%q rendered as %q, want it to contain %q", source, html, want)
+		}
+	}
+}
+
+func TestRenderLinksAreNoFollow(t *testing.T) {
+	html, err := Render("[site](https://example.com/)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(html, `rel="nofollow`) || !strings.Contains(html, `target="_blank"`) {
+		t.Errorf("Link rendered as %q", html)
+	}
+}
+
+func TestRenderStripsScripts(t *testing.T) {
+	for _, source := range []string{
+		"<script>alert(1)</script>",
+		"before <script>alert(1)</script> after",
+		"<div><script>alert(1)</script></div>",
+		"<img src=x onerror=alert(1)>",
+		"<a href=\"https://example.com/\" onclick=\"alert(1)\">click</a>",
+		"<iframe src=\"https://example.com/\"></iframe>",
+		"<style>body { display: none }</style>",
+	} {
+		html, err := Render(source)
+		if err != nil {
+			t.Errorf("Rendering %q failed: %s", source, err)
+			continue
+		}
+
+		// Text between the tags may remain, as text
+		for _, forbidden := range []string{"<script", "onerror", "onclick", "<iframe", "<style"} {
+			if strings.Contains(strings.ToLower(html), forbidden) {
+				t.Errorf("%q rendered as %q", source, html)
+				break
+			}
+		}
+	}
+}
+
+func TestRenderStripsDangerousLinks(t *testing.T) {
+	for _, source := range []string{
+		"[click](javascript:alert(1))",
+		"[click](JavaScript:alert(1))",
+		"[click](javascript&#58;alert(1))",
+		"[click](data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==)",
+		"![image](data:image/svg+xml;base64,PHN2Zz48L3N2Zz4=)",
+		"[click][ref]\n\n[ref]: javascript:alert(1)",
+		"<a href=\"javascript:alert(1)\">click</a>",
+		"[click](vbscript:msgbox(1))",
+	} {
+		html, err := Render(source)
+		if err != nil {
+			t.Errorf("Rendering %q failed: %s", source, err)
+			continue
+		}
+
+		lower := strings.ToLower(html)
+		for _, forbidden := range []string{"javascript:", "data:", "vbscript:", "alert(", "msgbox("} {
+			if strings.Contains(lower, forbidden) {
+				t.Errorf("%q rendered as %q", source, html)
+				break
+			}
+		}
+	}
+}
@@ -2,30 +2,39 @@ package main
 
 import (
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
-	"os"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
+	"github.com/irrenhaus/pushmearound_server/events"
 	"github.com/irrenhaus/pushmearound_server/httpresponse"
 	"github.com/irrenhaus/pushmearound_server/models"
-	"github.com/satori/go.uuid"
+	"github.com/irrenhaus/pushmearound_server/unfurl"
 )
 
-func sendMessageToDevice(msg models.Message, deviceID string) *models.ReceivedMessage {
+func sendMessageToDevice(msg models.Message, deviceID string, wrappedKey string) *models.ReceivedMessage {
 	destinationDevice, err := models.FindDevice(DB, deviceID)
 	if err != nil {
 		return nil
 	}
 
+	// Clipboard entries never show up as unread
 	receivedMessage := models.ReceivedMessage{
-		DeviceID:  destinationDevice.ID,
-		MessageID: msg.ID,
-		Unread:    true,
+		DeviceID:   destinationDevice.ID,
+		MessageID:  msg.ID,
+		Unread:     msg.ContentType != models.ContentTypeClipboard,
+		WrappedKey: wrappedKey,
 	}
 
 	if err := receivedMessage.Create(DB); err != nil {
@@ -35,117 +44,210 @@ func sendMessageToDevice(msg models.Message, deviceID string) *models.ReceivedMe
 	return &receivedMessage
 }
 
-func SendMessageHandler(resp http.ResponseWriter, req *http.Request) {
-	user, ok := context.Get(req, ContextKeyUser).(models.User)
-	if !ok {
-		httpresponse.InternalServerError("Could not convert user").WriteJSON(resp)
-		return
+const (
+	// Form fields are small, anything bigger is refused
+	maxMessageFieldSize = 64 * 1024
+	// Allowance for the form fields and multipart framing on top of the file
+	// when checking the Content-Length of a send request
+	maxMessageOverhead = 1024 * 1024
+)
+
+var errFieldTooLarge = errors.New("Form field too large")
+
+// readMessageField reads the value of a non-file multipart part
+func readMessageField(part io.Reader) (string, error) {
+	value, err := ioutil.ReadAll(io.LimitReader(part, maxMessageFieldSize+1))
+	if err != nil {
+		return "", err
 	}
 
-	// Store to 100M in memory
-	if err := req.ParseMultipartForm(100 * 1024 * 1024); err != nil {
-		log.WithFields(log.Fields{"error": err}).Warn("Failed to parse multipart form for message sending")
-		httpresponse.InternalServerError("Failed to parse multipart form").WriteJSON(resp)
-		return
+	if len(value) > maxMessageFieldSize {
+		return "", errFieldTooLarge
 	}
 
+	return string(value), nil
+}
+
+// buildMessage validates the form fields of a send request and creates the
+// (not yet stored) message from them
+func buildMessage(user models.User, fields map[string]string) (models.Message, error) {
 	msg := models.Message{
 		UserID: user.ID,
 	}
 
-	var contentType uint64
-	var err error
-
-	deviceID := req.PostFormValue("device_id")
-	device, err := models.FindDevice(DB, deviceID)
-	if err != nil {
-		httpresponse.BadRequest("No such device").WriteJSON(resp)
-		return
+	device, err := models.FindDevice(DB, fields["device_id"])
+	if err != nil || device.UserID != user.ID {
+		return msg, errors.New("No such device")
 	}
 	msg.DeviceID = device.ID
 
-	msg.Title = req.PostFormValue("title")
-	msg.Msg = req.PostFormValue("text")
-	msg.URL = req.PostFormValue("url")
+	msg.Title = fields["title"]
+	msg.Msg = fields["text"]
+	msg.URL = fields["url"]
 
-	if contentType, err = strconv.ParseUint(req.PostFormValue("content_type"), 10, 32); err != nil {
-		httpresponse.BadRequest("content_type has to be an uint").WriteJSON(resp)
-		return
+	contentType, err := strconv.ParseUint(fields["content_type"], 10, 32)
+	if err != nil {
+		return msg, errors.New("content_type has to be an uint")
 	}
 
 	if contentType >= models.ContentTypeLast {
-		httpresponse.BadRequest("Unknown content type").WriteJSON(resp)
-		return
+		return msg, errors.New("Unknown content type")
 	}
 
 	msg.ContentType = uint(contentType)
 
-	// File upload
-	if msg.ContentType == models.ContentTypeFile {
-		file, _, err := req.FormFile("sendfile")
+	switch fields["format"] {
+	case "", "plain":
+		msg.Format = models.FormatPlain
+	case models.FormatMarkdown:
+		if msg.ContentType != models.ContentTypeMessage {
+			return msg, errors.New("format markdown is only allowed for text messages")
+		}
+		msg.Format = models.FormatMarkdown
+	default:
+		return msg, errors.New("Unknown format")
+	}
+
+	if !allowsAttachments(msg.ContentType) && (fields["upload_id"] != "" || fields["sha256"] != "") {
+		return msg, errors.New("upload_id and sha256 are only allowed for file messages")
+	}
+
+	if msg.ContentType == models.ContentTypeEncrypted {
+		// The server must not learn anything about the content
+		if msg.Title != "" || msg.Msg != "" || msg.URL != "" || fields["file_name"] != "" {
+			return msg, errors.New("Encrypted messages may only carry ciphertext")
+		}
+
+		if _, err := base64.StdEncoding.DecodeString(fields["ciphertext"]); err != nil || fields["ciphertext"] == "" {
+			return msg, errors.New("ciphertext has to be base64 encoded")
+		}
+
+		msg.Ciphertext = fields["ciphertext"]
+	}
+
+	if models.HasPayload(msg.ContentType) {
+		payload, err := models.ValidatePayload(msg.ContentType, []byte(fields["payload"]))
 		if err != nil {
-			fmt.Println("File upload failed:")
-			fmt.Println(err)
-			httpresponse.BadRequest("Message type file selected without uploading file").WriteJSON(resp)
-			return
+			return msg, err
 		}
-		defer file.Close()
 
-		msg.File = uuid.NewV4().String()
+		msg.Payload = payload
+	} else if fields["payload"] != "" {
+		return msg, errors.New("payload is not allowed for this content type")
+	}
 
-		f, err := os.OpenFile("./upload/"+msg.File, os.O_WRONLY|os.O_CREATE, 0666)
+	if fields["reply_to"] != "" {
+		if msg.ContentType == models.ContentTypeClipboard {
+			return msg, errors.New("Clipboard entries can't be replies")
+		}
+
+		replyTo, err := strconv.ParseUint(fields["reply_to"], 10, 32)
 		if err != nil {
-			fmt.Println(err)
-			return
+			return msg, errors.New("reply_to has to be an uint")
 		}
-		defer f.Close()
 
-		if _, err := io.Copy(f, file); err != nil {
-			fmt.Println("Copying uploaded file failed:")
-			fmt.Println(err)
-			httpresponse.InternalServerError("File upload failed").WriteJSON(resp)
-			return
+		parent, err := models.FindMessage(DB, uint(replyTo))
+		if err != nil || parent.UserID != user.ID || parent.ContentType == models.ContentTypeClipboard {
+			return msg, errors.New("No such message to reply to")
 		}
+
+		msg.ReplyTo = parent.ID
+		msg.ThreadID = parent.ThreadID
 	}
 
-	if err := msg.Create(DB); err != nil {
-		httpresponse.InternalServerError("Sending the message failed").WriteJSON(resp)
-		os.Remove(msg.File)
-		return
+	if fields["actions"] != "" {
+		// The labels would give away what encrypted messages are about
+		if msg.ContentType == models.ContentTypeEncrypted || msg.ContentType == models.ContentTypeClipboard {
+			return msg, errors.New("actions are not allowed for this content type")
+		}
+
+		actions, err := models.ValidateActions([]byte(fields["actions"]))
+		if err != nil {
+			return msg, err
+		}
+
+		msg.Actions = actions
 	}
 
-	destinationDeviceID := req.PostFormValue("dest_id")
-	if err == nil {
-		// We have a destination device ID
-		if sendMessageToDevice(msg, destinationDeviceID) == nil {
-			httpresponse.InternalServerError("Sending the message failed").WriteJSON(resp)
-			msg.Delete(DB)
-			os.Remove(msg.File)
+	if fields["callback_url"] != "" {
+		if len(msg.Actions) == 0 {
+			return msg, errors.New("callback_url requires actions")
 		}
 
-		return
+		callbackURL, err := url.Parse(fields["callback_url"])
+		if err != nil || unfurl.CheckURL(callbackURL) != nil {
+			return msg, errors.New("callback_url has to be an http or https URL")
+		}
+
+		msg.CallbackURL = callbackURL.String()
+		if msg.CallbackSecret, err = newCallbackSecret(); err != nil {
+			return msg, err
+		}
 	}
 
-	sentMessages := []*models.ReceivedMessage{}
-	for _, device := range user.Devices {
-		receivedMessage := sendMessageToDevice(msg, device.ID)
-		if receivedMessage == nil {
-			httpresponse.InternalServerError(fmt.Sprintf("Sending the message to the device %s failed", device.Name)).WriteJSON(resp)
+	return msg, nil
+}
 
-			for _, sentMessage := range sentMessages {
-				sentMessage.Delete(DB)
-			}
+// allowsAttachments reports whether messages of the content type may carry
+// files. The files of encrypted messages are encrypted by the sender.
+func allowsAttachments(contentType uint) bool {
+	return contentType == models.ContentTypeFile || contentType == models.ContentTypeEncrypted || contentType == models.ContentTypeClipboard
+}
 
-			msg.Delete(DB)
-			os.Remove(msg.File)
+// Wrapped message keys are small, anything bigger is refused
+const maxWrappedKeySize = 1024
 
-			return
+// parseWrappedKeys reads the message keys of an encrypted message, a JSON
+// object mapping device IDs to the key wrapped for the device. All devices
+// have to belong to the user and have a public key.
+func parseWrappedKeys(user models.User, value string, destinationDeviceID string) (map[string]string, error) {
+	keys := map[string]string{}
+	if err := json.Unmarshal([]byte(value), &keys); err != nil || len(keys) == 0 {
+		return keys, errors.New("keys has to map device IDs to wrapped keys")
+	}
+
+	for deviceID, key := range keys {
+		if _, err := base64.StdEncoding.DecodeString(key); err != nil || key == "" || len(key) > maxWrappedKeySize {
+			return keys, fmt.Errorf("Invalid key for device %s", deviceID)
+		}
+
+		device, err := models.FindDevice(DB, deviceID)
+		if err != nil || device.UserID != user.ID {
+			return keys, fmt.Errorf("No such device %s", deviceID)
 		}
 
-		sentMessages = append(sentMessages, receivedMessage)
+		if device.PublicKey == "" {
+			return keys, fmt.Errorf("Device %s has no public key", deviceID)
+		}
+	}
+
+	if destinationDeviceID != "" && keys[destinationDeviceID] == "" {
+		return keys, errors.New("No key for the destination device")
+	}
+
+	return keys, nil
+}
+
+// Files attached to a single message
+const maxAttachments = 20
+
+// splitList splits a comma separated form value, ignoring empty entries
+func splitList(value string) []string {
+	entries := []string{}
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
 	}
 
-	return
+	return entries
+}
+
+// releaseAttachments drops the references to the files of claimed attachments
+func releaseAttachments(attachments []models.Attachment) {
+	for _, attachment := range attachments {
+		releaseUpload(attachment.File)
+	}
 }
 
 func UnreadMessageHandler(resp http.ResponseWriter, req *http.Request) {
@@ -223,11 +325,44 @@ func UnreadMessageHandler(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// Archived messages stay unread but don't clutter the list
+	unarchived := []models.Message{}
+	for _, msg := range msgs {
+		if !msg.Archived {
+			unarchived = append(unarchived, msg)
+		}
+	}
+	msgs = unarchived
+
+	threadUnread := map[uint]uint{}
+	for _, msg := range msgs {
+		threadUnread[msg.ThreadID]++
+	}
+
+	for i := range msgs {
+		msgs[i].ThreadUnread = threadUnread[msgs[i].ThreadID]
+	}
+
+	// Each device gets the message key wrapped for it
+	if deviceID != "" {
+		wrappedKeys := map[uint]string{}
+		for _, receivedMessage := range receivedMessages {
+			wrappedKeys[receivedMessage.MessageID] = receivedMessage.WrappedKey
+		}
+
+		for i := range msgs {
+			msgs[i].WrappedKey = wrappedKeys[msgs[i].ID]
+		}
+	}
+
 	response := httpresponse.Success("")
 	response.Data = msgs
 	response.WriteJSON(resp)
 }
 
+// UpdateMessageHandler changes the read state of a message. With a device
+// only the copy received by that device changes, otherwise the copies of all
+// devices of the user.
 func UpdateMessageHandler(resp http.ResponseWriter, req *http.Request) {
 	user, ok := context.Get(req, ContextKeyUser).(models.User)
 	if !ok {
@@ -243,43 +378,331 @@ func UpdateMessageHandler(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	msg, err := models.FindReceivedMessageByMessage(DB, uint(msgId))
+	value := req.FormValue("unread")
+	if value == "" {
+		httpresponse.Success("").WriteJSON(resp)
+		return
+	}
+
+	unread, err := strconv.ParseBool(value)
 	if err != nil {
-		if err != sql.ErrNoRows {
-			log.WithFields(log.Fields{"user": user.ID, "msg": msgId}).Error("SQL error while searching for message to update")
+		httpresponse.BadRequest("unread has to be a boolean").WriteJSON(resp)
+		return
+	}
+
+	updateReadState(resp, user, models.ReadStateUpdate{
+		DeviceID:   req.FormValue("device"),
+		MessageIDs: []uint{uint(msgId)},
+		Unread:     unread,
+	})
+}
+
+const (
+	historyDefaultLimit = 50
+	historyMaxLimit     = 200
+)
+
+// parseHistoryDate parses a plain date (2006-01-02). Messages only record the
+// day they were created on, so finer timestamps would be misleading.
+func parseHistoryDate(value string) (time.Time, error) {
+	return time.Parse("2006-01-02", value)
+}
+
+// parseHistoryFilter reads the page size and filter parameters shared by the
+// endpoints listing a users messages. The "before" cursor is endpoint specific.
+func parseHistoryFilter(req *http.Request) (models.MessageHistoryFilter, error) {
+	filter := models.MessageHistoryFilter{
+		Limit: historyDefaultLimit,
+	}
+
+	if limit := req.FormValue("limit"); limit != "" {
+		l, err := strconv.ParseUint(limit, 10, 32)
+		if err != nil || l == 0 {
+			return filter, errors.New("limit has to be a positive number")
+		}
+		if l > historyMaxLimit {
+			l = historyMaxLimit
+		}
+		filter.Limit = uint(l)
+	}
+
+	if contentType := req.FormValue("content_type"); contentType != "" {
+		ct, err := strconv.ParseUint(contentType, 10, 32)
+		if err != nil || ct >= models.ContentTypeLast {
+			return filter, errors.New("Unknown content type")
+		}
+		c := uint(ct)
+		filter.ContentType = &c
+	}
+
+	filter.DeviceID = req.FormValue("device")
+	filter.SenderDeviceID = req.FormValue("sender")
+
+	if include := req.FormValue("include_clipboard"); include != "" {
+		b, err := strconv.ParseBool(include)
+		if err != nil {
+			return filter, errors.New("include_clipboard has to be a boolean")
+		}
+		filter.IncludeClipboard = b
+	}
+
+	var err error
+	if filter.Starred, err = parseOptionalBool(req, "starred"); err != nil {
+		return filter, err
+	}
+	if filter.Pinned, err = parseOptionalBool(req, "pinned"); err != nil {
+		return filter, err
+	}
+	if filter.Archived, err = parseOptionalBool(req, "archived"); err != nil {
+		return filter, err
+	}
+
+	if since := req.FormValue("since"); since != "" {
+		t, err := parseHistoryDate(since)
+		if err != nil {
+			return filter, errors.New("since has to be a date (YYYY-MM-DD)")
 		}
+		filter.Since = t
+	}
 
-		httpresponse.NotFound("No such message found").WriteJSON(resp)
+	// until includes the whole day: only messages created before the next
+	// day are listed
+	if until := req.FormValue("until"); until != "" {
+		t, err := parseHistoryDate(until)
+		if err != nil {
+			return filter, errors.New("until has to be a date (YYYY-MM-DD)")
+		}
+		filter.Until = t.AddDate(0, 0, 1)
+	}
+
+	return filter, nil
+}
+
+// verifyFilterDevices makes sure that all devices a filter refers to belong to
+// the user. Otherwise an error response is written and false returned.
+func verifyFilterDevices(resp http.ResponseWriter, user models.User, filter models.MessageHistoryFilter) bool {
+	for _, deviceID := range []string{filter.DeviceID, filter.SenderDeviceID} {
+		if deviceID == "" {
+			continue
+		}
+
+		device, err := models.FindDevice(DB, deviceID)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				log.WithFields(log.Fields{"user": user.ID, "device": deviceID, "error": err}).Error("SQL error while finding device")
+			}
+
+			httpresponse.NotFound("No such device").WriteJSON(resp)
+			return false
+		}
+
+		if device.UserID != user.ID {
+			httpresponse.NotFound("No such device").WriteJSON(resp)
+			return false
+		}
+	}
+
+	return true
+}
+
+// ThreadMessageHandler returns the conversation the message belongs to, in
+// the order the messages were sent
+func ThreadMessageHandler(resp http.ResponseWriter, req *http.Request) {
+	user, ok := context.Get(req, ContextKeyUser).(models.User)
+	if !ok {
+		httpresponse.InternalServerError("Could not convert user").WriteJSON(resp)
 		return
 	}
 
-	device, err := models.FindDevice(DB, msg.DeviceID)
+	vars := mux.Vars(req)
+	msgID, err := strconv.ParseUint(vars["msg"], 10, 32)
+	if err != nil {
+		httpresponse.BadRequest("Invalid message ID").WriteJSON(resp)
+		return
+	}
+
+	msgs, err := models.FindThread(DB, user.ID, uint(msgID))
 	if err != nil {
 		if err != sql.ErrNoRows {
-			log.WithFields(log.Fields{"user": user.ID, "msg": msg.ID, "device": msg.DeviceID}).Error("SQL error while searching for messages device")
-		} else {
-			log.WithFields(log.Fields{"user": user.ID, "msg": msg.ID, "device": msg.DeviceID}).Warn("No device found for message")
+			log.WithFields(log.Fields{"user": user.ID, "msg": msgID, "error": err}).Error("SQL error while loading thread")
+			httpresponse.InternalServerError("Could not load the thread").WriteJSON(resp)
+			return
 		}
 
-		httpresponse.NotFound("Error resolving receiving device").WriteJSON(resp)
+		httpresponse.NotFound("No such message").WriteJSON(resp)
 		return
 	}
 
-	if device.UserID != user.ID {
-		httpresponse.NotFound("No such message").WriteJSON(resp)
+	response := httpresponse.Success("")
+	response.Data = msgs
+	response.WriteJSON(resp)
+}
+
+func HistoryMessageHandler(resp http.ResponseWriter, req *http.Request) {
+	user, ok := context.Get(req, ContextKeyUser).(models.User)
+	if !ok {
+		httpresponse.InternalServerError("Could not convert user").WriteJSON(resp)
+		return
+	}
+
+	filter, err := parseHistoryFilter(req)
+	if err != nil {
+		httpresponse.BadRequest(err.Error()).WriteJSON(resp)
+		return
+	}
+
+	if before := req.FormValue("before"); before != "" {
+		cursor, err := strconv.ParseUint(before, 10, 32)
+		if err != nil {
+			httpresponse.BadRequest("before has to be a message ID").WriteJSON(resp)
+			return
+		}
+		filter.Before = uint(cursor)
+	}
+
+	if !verifyFilterDevices(resp, user, filter) {
+		return
+	}
+
+	entries, err := models.FindMessageHistory(DB, user.ID, filter)
+	if err != nil {
+		log.WithFields(log.Fields{"user": user.ID, "error": err}).Error("SQL error while loading message history")
+		httpresponse.InternalServerError("Could not load message history").WriteJSON(resp)
 		return
 	}
 
-	dirty := false
+	// Only hand out a cursor if there might be more messages
+	var nextCursor uint
+	if uint(len(entries)) == filter.Limit {
+		nextCursor = entries[len(entries)-1].Message.ID
+	}
 
-	unread, err := strconv.ParseBool(req.FormValue("unread"))
+	response := httpresponse.Success("")
+	response.Data = map[string]interface{}{
+		"messages":    entries,
+		"next_cursor": nextCursor,
+	}
+	response.WriteJSON(resp)
+}
+
+// Search cursors are handed out as "<rank>:<message id>"
+func parseSearchCursor(value string) (*models.MessageSearchCursor, error) {
+	fields := strings.Split(value, ":")
+	if len(fields) != 2 {
+		return nil, errors.New("Invalid search cursor")
+	}
+
+	rank, err := strconv.ParseFloat(fields[0], 64)
 	if err != nil {
-		msg.Unread = unread
+		return nil, errors.New("Invalid search cursor")
 	}
 
-	if dirty {
-		if err := msg.Update(DB); err != nil {
-			log.WithFields(log.Fields{"msg": msg.ID, "error": err}).Error("SQL error while updating received message")
+	id, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return nil, errors.New("Invalid search cursor")
+	}
+
+	return &models.MessageSearchCursor{Rank: rank, ID: uint(id)}, nil
+}
+
+func SearchMessageHandler(resp http.ResponseWriter, req *http.Request) {
+	user, ok := context.Get(req, ContextKeyUser).(models.User)
+	if !ok {
+		httpresponse.InternalServerError("Could not convert user").WriteJSON(resp)
+		return
+	}
+
+	search := strings.TrimSpace(req.FormValue("q"))
+	if search == "" {
+		httpresponse.BadRequest("Please specify a search query").WriteJSON(resp)
+		return
+	}
+
+	filter, err := parseHistoryFilter(req)
+	if err != nil {
+		httpresponse.BadRequest(err.Error()).WriteJSON(resp)
+		return
+	}
+
+	var cursor *models.MessageSearchCursor
+	if before := req.FormValue("before"); before != "" {
+		if cursor, err = parseSearchCursor(before); err != nil {
+			httpresponse.BadRequest(err.Error()).WriteJSON(resp)
+			return
+		}
+	}
+
+	if !verifyFilterDevices(resp, user, filter) {
+		return
+	}
+
+	results, err := models.SearchMessages(DB, user.ID, search, filter, cursor)
+	if err != nil {
+		log.WithFields(log.Fields{"user": user.ID, "query": search, "error": err}).Error("SQL error while searching messages")
+		httpresponse.InternalServerError("Could not search messages").WriteJSON(resp)
+		return
+	}
+
+	nextCursor := ""
+	if uint(len(results)) == filter.Limit {
+		last := results[len(results)-1]
+		nextCursor = fmt.Sprintf("%s:%d", strconv.FormatFloat(last.Rank, 'g', -1, 64), last.Message.ID)
+	}
+
+	response := httpresponse.Success("")
+	response.Data = map[string]interface{}{
+		"messages":    results,
+		"next_cursor": nextCursor,
+	}
+	response.WriteJSON(resp)
+}
+
+func DeleteMessageHandler(resp http.ResponseWriter, req *http.Request) {
+	user, ok := context.Get(req, ContextKeyUser).(models.User)
+	if !ok {
+		httpresponse.InternalServerError("Could not convert user").WriteJSON(resp)
+		return
+	}
+
+	vars := mux.Vars(req)
+	msgID, err := strconv.ParseUint(vars["msg"], 10, 32)
+	if err != nil {
+		httpresponse.BadRequest("Invalid message ID").WriteJSON(resp)
+		return
+	}
+
+	msg, err := models.FindMessage(DB, uint(msgID))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.WithFields(log.Fields{"user": user.ID, "msg": msgID, "error": err}).Error("SQL error while searching for message to delete")
 		}
+
+		httpresponse.NotFound("No such message").WriteJSON(resp)
+		return
+	}
+
+	if msg.UserID != user.ID {
+		httpresponse.NotFound("No such message").WriteJSON(resp)
+		return
 	}
+
+	if err := msg.Recall(DB); err != nil {
+		log.WithFields(log.Fields{"user": user.ID, "msg": msg.ID, "error": err}).Error("SQL error while deleting message")
+		httpresponse.InternalServerError("Deleting the message failed").WriteJSON(resp)
+		return
+	}
+
+	if len(msg.Attachments) > 0 {
+		releaseAttachments(msg.Attachments)
+		updateStorageUsage(user.ID)
+	}
+
+	Events.Publish(user.ID, events.Event{
+		Type: events.TypeMessageRecalled,
+		Data: map[string]uint{
+			"message_id": msg.ID,
+		},
+	})
+
+	httpresponse.Success("Message deleted").WriteJSON(resp)
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseHistoryFilterDates(t *testing.T) {
+	req := httptest.NewRequest("GET", "/msg/history?since=2017-03-01&until=2017-03-31", nil)
+
+	filter, err := parseHistoryFilter(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC); !filter.Since.Equal(want) {
+		t.Errorf("since parsed as %s, want %s", filter.Since, want)
+	}
+
+	// The whole last day is included
+	if want := time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC); !filter.Until.Equal(want) {
+		t.Errorf("until parsed as %s, want %s", filter.Until, want)
+	}
+}
+
+func TestParseHistoryFilterRejectsTimestamps(t *testing.T) {
+	for _, query := range []string{
+		"since=2017-03-01T12:00:00Z",
+		"until=2017-03-31T12:00:00Z",
+		"since=yesterday",
+		"until=2017-02-30",
+	} {
+		req := httptest.NewRequest("GET", "/msg/history?"+query, nil)
+		if _, err := parseHistoryFilter(req); err == nil {
+			t.Errorf("parseHistoryFilter accepted %s", query)
+		}
+	}
+}
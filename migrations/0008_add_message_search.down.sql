@@ -0,0 +1,5 @@
+DROP INDEX messages_search_vector_idx;
+DROP TRIGGER messages_search_vector_trigger ON messages;
+DROP FUNCTION messages_search_vector_update();
+ALTER TABLE messages DROP COLUMN search_vector;
+ALTER TABLE messages DROP COLUMN file_name;
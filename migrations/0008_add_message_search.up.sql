@@ -0,0 +1,23 @@
+ALTER TABLE messages ADD COLUMN file_name text;
+ALTER TABLE messages ADD COLUMN search_vector tsvector;
+
+CREATE FUNCTION messages_search_vector_update() RETURNS trigger AS $$
+BEGIN
+    NEW.search_vector :=
+        setweight(to_tsvector('simple', coalesce(NEW.title, '')), 'A') ||
+        setweight(to_tsvector('simple', coalesce(NEW.msg, '')), 'B') ||
+        setweight(to_tsvector('simple', coalesce(NEW.url, '')), 'C') ||
+        setweight(to_tsvector('simple', coalesce(NEW.file_name, '')), 'C');
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER messages_search_vector_trigger BEFORE INSERT OR UPDATE ON messages
+    FOR EACH ROW EXECUTE PROCEDURE messages_search_vector_update();
+
+UPDATE messages SET search_vector =
+    setweight(to_tsvector('simple', coalesce(title, '')), 'A') ||
+    setweight(to_tsvector('simple', coalesce(msg, '')), 'B') ||
+    setweight(to_tsvector('simple', coalesce(url, '')), 'C');
+
+CREATE INDEX messages_search_vector_idx ON messages USING gin(search_vector);
@@ -0,0 +1 @@
+ALTER TABLE received_messages DROP COLUMN dismissed;
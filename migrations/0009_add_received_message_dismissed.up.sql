@@ -0,0 +1 @@
+ALTER TABLE received_messages ADD COLUMN dismissed boolean NOT NULL DEFAULT false;
@@ -0,0 +1,17 @@
+CREATE TABLE attachments (
+    id SERIAL PRIMARY KEY,
+    created_at date NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    message_id integer NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    file varchar(36) NOT NULL UNIQUE,
+    file_name text NOT NULL,
+    mime_type varchar(255) NOT NULL,
+    size bigint NOT NULL,
+    sha256 varchar(64) NOT NULL
+);
+
+CREATE INDEX attachments_message_id_idx ON attachments (message_id);
+
+-- Size and hash of files uploaded before this migration are unknown
+INSERT INTO attachments (message_id, file, file_name, mime_type, size, sha256)
+    SELECT id, file, coalesce(file_name, file), 'application/octet-stream', 0, ''
+    FROM messages WHERE file IS NOT NULL AND file <> '';
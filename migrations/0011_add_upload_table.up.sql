@@ -0,0 +1,14 @@
+CREATE TABLE uploads (
+    id varchar(36) PRIMARY KEY,
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at timestamp NOT NULL,
+    user_id integer NOT NULL REFERENCES users (id),
+    length bigint NOT NULL,
+    upload_offset bigint NOT NULL DEFAULT 0,
+    file_name text NOT NULL,
+    mime_type varchar(255) NOT NULL DEFAULT '',
+    sha256 varchar(64) NOT NULL DEFAULT '',
+    completed boolean NOT NULL DEFAULT false
+);
+
+CREATE INDEX uploads_expires_at_idx ON uploads (expires_at);
@@ -0,0 +1 @@
+ALTER TABLE users DROP COLUMN max_upload_size;
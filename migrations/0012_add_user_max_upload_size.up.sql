@@ -0,0 +1,2 @@
+-- NULL means the server wide default applies
+ALTER TABLE users ADD COLUMN max_upload_size bigint;
@@ -0,0 +1,4 @@
+DROP INDEX attachments_sha256_idx;
+DROP INDEX attachments_file_idx;
+ALTER TABLE attachments ADD CONSTRAINT attachments_file_key UNIQUE (file);
+DROP TABLE blobs;
@@ -0,0 +1,24 @@
+-- Stored files are shared between all attachments with the same content, no
+-- matter which user sent them.
+-- refs counts the attachments referencing a blob.
+CREATE TABLE blobs (
+    file varchar(36) PRIMARY KEY,
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    sha256 varchar(64) UNIQUE,
+    size bigint NOT NULL,
+    refs integer NOT NULL DEFAULT 1
+);
+
+-- Files uploaded before attachments were hashed can't be deduplicated.
+-- Neither can files which were stored several times already, only the first
+-- copy of each content gets the hash.
+INSERT INTO blobs (file, sha256, size, refs)
+    SELECT file, CASE WHEN row_number() OVER (PARTITION BY sha256 ORDER BY file) = 1 THEN sha256 END, size, refs
+    FROM (
+        SELECT file, NULLIF(min(sha256), '') AS sha256, max(size) AS size, count(*) AS refs
+        FROM attachments GROUP BY file
+    ) files;
+
+ALTER TABLE attachments DROP CONSTRAINT attachments_file_key;
+CREATE INDEX attachments_file_idx ON attachments (file);
+CREATE INDEX attachments_sha256_idx ON attachments (sha256);
@@ -0,0 +1,6 @@
+ALTER TABLE users DROP COLUMN storage_files;
+ALTER TABLE users DROP COLUMN storage_bytes;
+ALTER TABLE users DROP COLUMN max_files;
+ALTER TABLE users DROP COLUMN max_storage_bytes;
+ALTER TABLE users DROP COLUMN plan_id;
+DROP TABLE plans;
@@ -0,0 +1,23 @@
+-- Limits are NULL for "unlimited"
+CREATE TABLE plans (
+    id SERIAL PRIMARY KEY,
+    created_at date NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    name varchar(40) NOT NULL UNIQUE,
+    max_storage_bytes bigint,
+    max_files integer
+);
+
+INSERT INTO plans (id, name, max_storage_bytes, max_files) VALUES (1, 'default', 1073741824, 1000);
+SELECT setval('plans_id_seq', 1);
+
+-- Per user limits override the ones of the plan. storage_bytes and
+-- storage_files cache the current usage.
+ALTER TABLE users ADD COLUMN plan_id integer NOT NULL DEFAULT 1 REFERENCES plans (id);
+ALTER TABLE users ADD COLUMN max_storage_bytes bigint;
+ALTER TABLE users ADD COLUMN max_files integer;
+ALTER TABLE users ADD COLUMN storage_bytes bigint NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN storage_files integer NOT NULL DEFAULT 0;
+
+UPDATE users SET
+    storage_bytes = (SELECT coalesce(sum(attachments.size), 0) FROM attachments JOIN messages ON attachments.message_id = messages.id WHERE messages.user_id = users.id),
+    storage_files = (SELECT count(*) FROM attachments JOIN messages ON attachments.message_id = messages.id WHERE messages.user_id = users.id);
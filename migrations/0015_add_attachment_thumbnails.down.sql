@@ -0,0 +1,3 @@
+ALTER TABLE attachments DROP COLUMN thumbnail;
+ALTER TABLE attachments DROP COLUMN height;
+ALTER TABLE attachments DROP COLUMN width;
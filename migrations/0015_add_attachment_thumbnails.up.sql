@@ -0,0 +1,3 @@
+ALTER TABLE attachments ADD COLUMN width integer NOT NULL DEFAULT 0;
+ALTER TABLE attachments ADD COLUMN height integer NOT NULL DEFAULT 0;
+ALTER TABLE attachments ADD COLUMN thumbnail boolean NOT NULL DEFAULT false;
@@ -0,0 +1 @@
+ALTER TABLE attachments ADD COLUMN position integer NOT NULL DEFAULT 0;
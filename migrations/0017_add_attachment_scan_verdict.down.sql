@@ -0,0 +1,2 @@
+ALTER TABLE attachments DROP COLUMN scan_signature;
+ALTER TABLE attachments DROP COLUMN scan_status;
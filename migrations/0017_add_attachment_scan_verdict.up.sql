@@ -0,0 +1,2 @@
+ALTER TABLE attachments ADD COLUMN scan_status varchar(16) NOT NULL DEFAULT '';
+ALTER TABLE attachments ADD COLUMN scan_signature text NOT NULL DEFAULT '';
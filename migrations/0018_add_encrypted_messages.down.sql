@@ -0,0 +1,3 @@
+ALTER TABLE received_messages DROP COLUMN wrapped_key;
+ALTER TABLE messages DROP COLUMN ciphertext;
+ALTER TABLE devices DROP COLUMN public_key;
@@ -0,0 +1,7 @@
+-- X25519 public key of the device, base64 encoded
+ALTER TABLE devices ADD COLUMN public_key varchar(64) NOT NULL DEFAULT '';
+
+-- Encrypted messages keep nothing but the ciphertext, the message key is
+-- wrapped for every receiving device separately
+ALTER TABLE messages ADD COLUMN ciphertext text NOT NULL DEFAULT '';
+ALTER TABLE received_messages ADD COLUMN wrapped_key text NOT NULL DEFAULT '';
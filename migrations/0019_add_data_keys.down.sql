@@ -0,0 +1,12 @@
+CREATE OR REPLACE FUNCTION messages_search_vector_update() RETURNS trigger AS $$
+BEGIN
+    NEW.search_vector :=
+        setweight(to_tsvector('simple', coalesce(NEW.title, '')), 'A') ||
+        setweight(to_tsvector('simple', coalesce(NEW.msg, '')), 'B') ||
+        setweight(to_tsvector('simple', coalesce(NEW.url, '')), 'C') ||
+        setweight(to_tsvector('simple', coalesce(NEW.file_name, '')), 'C');
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TABLE data_keys;
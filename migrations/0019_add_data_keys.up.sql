@@ -0,0 +1,28 @@
+CREATE TABLE data_keys (
+    id SERIAL PRIMARY KEY,
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    user_id integer NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    -- The data key encrypted with the master key identified by master_key_id
+    wrapped_key text NOT NULL,
+    master_key_id varchar(16) NOT NULL
+);
+
+CREATE INDEX data_keys_user_id_idx ON data_keys (user_id);
+CREATE INDEX data_keys_master_key_id_idx ON data_keys (master_key_id);
+
+-- Encrypted columns must not end up in the search index
+CREATE OR REPLACE FUNCTION messages_search_vector_update() RETURNS trigger AS $$
+BEGIN
+    IF NEW.title LIKE 'enc:%' OR NEW.msg LIKE 'enc:%' OR NEW.url LIKE 'enc:%' THEN
+        NEW.search_vector := setweight(to_tsvector('simple', coalesce(NEW.file_name, '')), 'C');
+        RETURN NEW;
+    END IF;
+
+    NEW.search_vector :=
+        setweight(to_tsvector('simple', coalesce(NEW.title, '')), 'A') ||
+        setweight(to_tsvector('simple', coalesce(NEW.msg, '')), 'B') ||
+        setweight(to_tsvector('simple', coalesce(NEW.url, '')), 'C') ||
+        setweight(to_tsvector('simple', coalesce(NEW.file_name, '')), 'C');
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
@@ -0,0 +1 @@
+ALTER TABLE messages ADD COLUMN format varchar(16) NOT NULL DEFAULT '';
@@ -0,0 +1,5 @@
+ALTER TABLE messages DROP COLUMN responded_at;
+ALTER TABLE messages DROP COLUMN action_response;
+ALTER TABLE messages DROP COLUMN callback_secret;
+ALTER TABLE messages DROP COLUMN callback_url;
+ALTER TABLE messages DROP COLUMN actions;
@@ -0,0 +1,5 @@
+ALTER TABLE messages ADD COLUMN actions jsonb;
+ALTER TABLE messages ADD COLUMN callback_url text NOT NULL DEFAULT '';
+ALTER TABLE messages ADD COLUMN callback_secret varchar(64) NOT NULL DEFAULT '';
+ALTER TABLE messages ADD COLUMN action_response varchar(32) NOT NULL DEFAULT '';
+ALTER TABLE messages ADD COLUMN responded_at timestamp;
@@ -0,0 +1,3 @@
+DROP INDEX messages_thread_id_idx;
+ALTER TABLE messages DROP COLUMN thread_id;
+ALTER TABLE messages DROP COLUMN reply_to;
@@ -0,0 +1,5 @@
+ALTER TABLE messages ADD COLUMN reply_to integer REFERENCES messages (id) ON DELETE SET NULL;
+ALTER TABLE messages ADD COLUMN thread_id integer;
+UPDATE messages SET thread_id = id;
+ALTER TABLE messages ALTER COLUMN thread_id SET NOT NULL;
+CREATE INDEX messages_thread_id_idx ON messages (thread_id);
@@ -0,0 +1,3 @@
+ALTER TABLE messages DROP COLUMN archived;
+ALTER TABLE messages DROP COLUMN pinned;
+ALTER TABLE messages DROP COLUMN starred;
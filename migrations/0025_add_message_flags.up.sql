@@ -0,0 +1,3 @@
+ALTER TABLE messages ADD COLUMN starred boolean NOT NULL DEFAULT false;
+ALTER TABLE messages ADD COLUMN pinned boolean NOT NULL DEFAULT false;
+ALTER TABLE messages ADD COLUMN archived boolean NOT NULL DEFAULT false;
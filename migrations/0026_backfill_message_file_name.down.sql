@@ -0,0 +1,2 @@
+ALTER TABLE messages ALTER COLUMN file_name DROP NOT NULL;
+ALTER TABLE messages ALTER COLUMN file_name DROP DEFAULT;
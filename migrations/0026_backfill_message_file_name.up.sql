@@ -0,0 +1,4 @@
+-- Messages from before 0008 have no file name, the application expects ''
+UPDATE messages SET file_name = '' WHERE file_name IS NULL;
+ALTER TABLE messages ALTER COLUMN file_name SET DEFAULT '';
+ALTER TABLE messages ALTER COLUMN file_name SET NOT NULL;
@@ -0,0 +1,17 @@
+CREATE OR REPLACE FUNCTION messages_search_vector_update() RETURNS trigger AS $$
+BEGIN
+    IF NEW.title LIKE 'enc:%' OR NEW.msg LIKE 'enc:%' OR NEW.url LIKE 'enc:%' THEN
+        NEW.search_vector := setweight(to_tsvector('simple', coalesce(NEW.file_name, '')), 'C');
+        RETURN NEW;
+    END IF;
+
+    NEW.search_vector :=
+        setweight(to_tsvector('simple', coalesce(NEW.title, '')), 'A') ||
+        setweight(to_tsvector('simple', coalesce(NEW.msg, '')), 'B') ||
+        setweight(to_tsvector('simple', coalesce(NEW.url, '')), 'C') ||
+        setweight(to_tsvector('simple', coalesce(NEW.file_name, '')), 'C');
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+ALTER TABLE messages DROP COLUMN sealed;
@@ -0,0 +1,32 @@
+ALTER TABLE messages ADD COLUMN sealed boolean NOT NULL DEFAULT false;
+
+-- Sealed messages are only searchable by their file name
+CREATE OR REPLACE FUNCTION messages_search_vector_update() RETURNS trigger AS $$
+BEGIN
+    IF NEW.sealed THEN
+        NEW.search_vector := setweight(to_tsvector('simple', coalesce(NEW.file_name, '')), 'C');
+        RETURN NEW;
+    END IF;
+
+    NEW.search_vector :=
+        setweight(to_tsvector('simple', coalesce(NEW.title, '')), 'A') ||
+        setweight(to_tsvector('simple', coalesce(NEW.msg, '')), 'B') ||
+        setweight(to_tsvector('simple', coalesce(NEW.url, '')), 'C') ||
+        setweight(to_tsvector('simple', coalesce(NEW.file_name, '')), 'C');
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+-- Before this column sealed contents were told apart by their prefix. All
+-- contents of a message are sealed at once, so a message of a user with a
+-- data key counts as sealed if every non-empty field looks sealed.
+UPDATE messages SET sealed = true
+    WHERE EXISTS (SELECT 1 FROM data_keys WHERE data_keys.user_id = messages.user_id)
+    AND (coalesce(title, '') <> '' OR coalesce(msg, '') <> '' OR coalesce(url, '') <> ''
+        OR payload IS NOT NULL OR preview IS NOT NULL OR actions IS NOT NULL)
+    AND (coalesce(title, '') = '' OR title LIKE 'enc:v1:%')
+    AND (coalesce(msg, '') = '' OR msg LIKE 'enc:v1:%')
+    AND (coalesce(url, '') = '' OR url LIKE 'enc:v1:%')
+    AND (payload IS NULL OR jsonb_typeof(payload) = 'string')
+    AND (preview IS NULL OR jsonb_typeof(preview) = 'string')
+    AND (actions IS NULL OR jsonb_typeof(actions) = 'string');
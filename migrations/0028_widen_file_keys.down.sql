@@ -0,0 +1,3 @@
+-- Fails as long as attachments refer to quarantined files
+ALTER TABLE blobs ALTER COLUMN file TYPE varchar(36);
+ALTER TABLE attachments ALTER COLUMN file TYPE varchar(36);
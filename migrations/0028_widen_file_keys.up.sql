@@ -0,0 +1,4 @@
+-- Quarantined files are stored under their key with a prefix, which doesn't
+-- fit into the 36 characters of a UUID
+ALTER TABLE attachments ALTER COLUMN file TYPE text;
+ALTER TABLE blobs ALTER COLUMN file TYPE text;
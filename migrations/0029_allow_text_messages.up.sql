@@ -0,0 +1,3 @@
+-- Plain text messages have the content type 0
+ALTER TABLE messages DROP CONSTRAINT messages_content_type_check;
+ALTER TABLE messages ADD CONSTRAINT messages_content_type_check CHECK (content_type >= 0);
@@ -0,0 +1,2 @@
+-- Fails as long as there are longer titles
+ALTER TABLE messages ALTER COLUMN title TYPE varchar(255);
@@ -0,0 +1,3 @@
+-- Sealed titles are about a third longer than the title plus a header and
+-- don't fit into 255 characters
+ALTER TABLE messages ALTER COLUMN title TYPE text;
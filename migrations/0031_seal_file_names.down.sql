@@ -0,0 +1,20 @@
+-- File names sealed in the meantime stay sealed and show up as ciphertext
+CREATE OR REPLACE FUNCTION messages_search_vector_update() RETURNS trigger AS $$
+BEGIN
+    IF NEW.sealed THEN
+        NEW.search_vector := setweight(to_tsvector('simple', coalesce(NEW.file_name, '')), 'C');
+        RETURN NEW;
+    END IF;
+
+    NEW.search_vector :=
+        setweight(to_tsvector('simple', coalesce(NEW.title, '')), 'A') ||
+        setweight(to_tsvector('simple', coalesce(NEW.msg, '')), 'B') ||
+        setweight(to_tsvector('simple', coalesce(NEW.url, '')), 'C') ||
+        setweight(to_tsvector('simple', coalesce(NEW.file_name, '')), 'C');
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+ALTER TABLE uploads DROP COLUMN sealed;
+ALTER TABLE attachments DROP COLUMN sealed;
+ALTER TABLE messages DROP COLUMN metadata_sealed;
@@ -0,0 +1,27 @@
+-- File names and callback URLs are sealed together with the contents. Rows
+-- sealed before keep them in plaintext, the flags tell them apart.
+ALTER TABLE messages ADD COLUMN metadata_sealed boolean NOT NULL DEFAULT false;
+ALTER TABLE attachments ADD COLUMN sealed boolean NOT NULL DEFAULT false;
+ALTER TABLE uploads ADD COLUMN sealed boolean NOT NULL DEFAULT false;
+
+-- Messages with sealed file names can't be searched at all
+CREATE OR REPLACE FUNCTION messages_search_vector_update() RETURNS trigger AS $$
+BEGIN
+    IF NEW.metadata_sealed THEN
+        NEW.search_vector := to_tsvector('simple', '');
+        RETURN NEW;
+    END IF;
+
+    IF NEW.sealed THEN
+        NEW.search_vector := setweight(to_tsvector('simple', coalesce(NEW.file_name, '')), 'C');
+        RETURN NEW;
+    END IF;
+
+    NEW.search_vector :=
+        setweight(to_tsvector('simple', coalesce(NEW.title, '')), 'A') ||
+        setweight(to_tsvector('simple', coalesce(NEW.msg, '')), 'B') ||
+        setweight(to_tsvector('simple', coalesce(NEW.url, '')), 'C') ||
+        setweight(to_tsvector('simple', coalesce(NEW.file_name, '')), 'C');
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
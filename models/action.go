@@ -0,0 +1,135 @@
+package models
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"unicode/utf8"
+)
+
+// Limits for the actions of a message
+const (
+	MaxActions         = 3
+	maxActionLabelSize = 40
+)
+
+// Action is a button shown with a message, e.g. "Approve". The ID is what
+// the sender gets back when a device picks the action.
+type Action struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+}
+
+var actionIDRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+
+var ErrNoSuchAction = errors.New("No such action")
+var ErrAlreadyAnswered = errors.New("The message has been answered already")
+
+// ValidateActions checks the action definitions sent with a message, a JSON
+// array of actions
+func ValidateActions(raw []byte) (json.RawMessage, error) {
+	actions := []Action{}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&actions); err != nil {
+		return nil, fmt.Errorf("Invalid actions: %s", err)
+	}
+
+	if len(actions) == 0 || len(actions) > MaxActions {
+		return nil, fmt.Errorf("A message needs between 1 and %d actions", MaxActions)
+	}
+
+	seen := map[string]bool{}
+	for _, action := range actions {
+		if !actionIDRegexp.MatchString(action.ID) {
+			return nil, fmt.Errorf("Invalid action ID %q", action.ID)
+		}
+
+		if seen[action.ID] {
+			return nil, fmt.Errorf("Duplicate action ID %q", action.ID)
+		}
+		seen[action.ID] = true
+
+		if action.Label == "" || utf8.RuneCountInString(action.Label) > maxActionLabelSize {
+			return nil, fmt.Errorf("The label of action %q has to be between 1 and %d characters", action.ID, maxActionLabelSize)
+		}
+	}
+
+	return json.Marshal(actions)
+}
+
+// FindAction returns the action of the message with the given ID
+func (msg *Message) FindAction(id string) (Action, bool) {
+	actions := []Action{}
+	if len(msg.Actions) > 0 {
+		if err := json.Unmarshal(msg.Actions, &actions); err != nil {
+			return Action{}, false
+		}
+	}
+
+	for _, action := range actions {
+		if action.ID == id {
+			return action, true
+		}
+	}
+
+	return Action{}, false
+}
+
+// RespondToMessage records the action chosen for a message of the user. Only
+// the first response counts, later ones fail with ErrAlreadyAnswered.
+func RespondToMessage(DB *sql.DB, userID uint, messageID uint, actionID string) (Message, Action, error) {
+	msg := Message{}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return msg, Action{}, err
+	}
+
+	rows, err := tx.Query("SELECT "+messageColumns+" FROM messages WHERE id=$1 AND user_id=$2 FOR UPDATE", messageID, userID)
+	if err != nil {
+		tx.Rollback()
+		return msg, Action{}, err
+	}
+
+	found := rows.Next()
+	if found {
+		err = scanMessage(&msg, rows)
+	} else {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	if err != nil {
+		tx.Rollback()
+		return msg, Action{}, err
+	}
+
+	if !found {
+		tx.Rollback()
+		return msg, Action{}, sql.ErrNoRows
+	}
+
+	action, ok := msg.FindAction(actionID)
+	if !ok {
+		tx.Rollback()
+		return msg, action, ErrNoSuchAction
+	}
+
+	if msg.ActionResponse != "" {
+		tx.Rollback()
+		return msg, action, ErrAlreadyAnswered
+	}
+
+	if err := tx.QueryRow("UPDATE messages SET action_response=$2, responded_at=current_timestamp(), last_modified_at=current_timestamp() WHERE id=$1 RETURNING responded_at, last_modified_at", msg.ID, action.ID).Scan(&msg.RespondedAt, &msg.LastModifiedAt); err != nil {
+		tx.Rollback()
+		return msg, action, err
+	}
+	msg.ActionResponse = action.ID
+
+	return msg, action, tx.Commit()
+}
@@ -0,0 +1,200 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Results of scanning an attachment. Attachments stored while scanning was
+// disabled have an empty status.
+const (
+	ScanStatusClean    = "clean"
+	ScanStatusInfected = "infected"
+)
+
+// Attachment describes an uploaded file. File is the name the upload is
+// stored under, FileName the name it was uploaded with.
+type Attachment struct {
+	ID        uint
+	CreatedAt time.Time
+	MessageID uint
+	File      string
+	FileName  string
+	MimeType  string
+	Size      int64
+	SHA256    string
+	// Dimensions of images, zero for everything else
+	Width     int
+	Height    int
+	Thumbnail bool
+	// Order of the attachment within its message
+	Position      int
+	ScanStatus    string
+	ScanSignature string
+	ThumbnailURL  string
+	// Whether the file name is stored encrypted at rest
+	Sealed bool `json:"-"`
+}
+
+// attachmentFields returns the scan destinations for a row of the attachments
+// table
+func attachmentFields(a *Attachment) []interface{} {
+	return []interface{}{&a.ID, &a.CreatedAt, &a.MessageID, &a.File, &a.FileName, &a.MimeType, &a.Size, &a.SHA256, &a.Width, &a.Height, &a.Thumbnail, &a.Position, &a.ScanStatus, &a.ScanSignature, &a.Sealed}
+}
+
+// Infected reports whether the scanner found malware in the file
+func (a *Attachment) Infected() bool {
+	return a.ScanStatus == ScanStatusInfected
+}
+
+func (a *Attachment) afterScan() error {
+	if a.Thumbnail {
+		a.ThumbnailURL = "/files/" + a.File + "/thumbnail"
+	}
+
+	if !a.Sealed {
+		return nil
+	}
+
+	if Sealer == nil {
+		return errors.New("Attachment is encrypted but no sealer is set")
+	}
+
+	var err error
+	a.FileName, err = Sealer.Open(a.FileName)
+	return err
+}
+
+func scanAttachment(a *Attachment, row *sql.Row) error {
+	if err := row.Scan(attachmentFields(a)...); err != nil {
+		return err
+	}
+
+	return a.afterScan()
+}
+
+func scanMultiAttachments(attachments *[]Attachment, rows *sql.Rows) error {
+	for rows.Next() {
+		var a Attachment
+		if err := rows.Scan(attachmentFields(&a)...); err != nil {
+			rows.Close()
+			return err
+		}
+		if err := a.afterScan(); err != nil {
+			rows.Close()
+			return err
+		}
+		*attachments = append(*attachments, a)
+	}
+
+	return rows.Err()
+}
+
+// FindReceivedAttachment finds an attachment stored as file which belongs to a
+// message received by one of the users devices
+func FindReceivedAttachment(DB *sql.DB, userID uint, file string) (Attachment, error) {
+	a := Attachment{}
+	row := DB.QueryRow("SELECT attachments.* FROM attachments JOIN received_messages ON received_messages.message_id = attachments.message_id JOIN devices ON received_messages.device_id = devices.id WHERE devices.user_id=$1 AND attachments.file=$2 LIMIT 1", userID, file)
+	err := scanAttachment(&a, row)
+
+	return a, err
+}
+
+// FindUserAttachmentBySHA256 finds an attachment with the given content which
+// the user sent before. Infected files are never returned.
+func FindUserAttachmentBySHA256(DB *sql.DB, userID uint, sha256 string) (Attachment, error) {
+	a := Attachment{}
+	row := DB.QueryRow("SELECT attachments.* FROM attachments JOIN messages ON attachments.message_id = messages.id WHERE messages.user_id=$1 AND attachments.sha256=$2 AND attachments.scan_status <> 'infected' ORDER BY attachments.id DESC LIMIT 1", userID, sha256)
+	err := scanAttachment(&a, row)
+
+	return a, err
+}
+
+func FindAttachmentsByMessages(DB *sql.DB, messageIDs []uint) ([]Attachment, error) {
+	attachments := []Attachment{}
+
+	ids := []int64{}
+	for _, id := range messageIDs {
+		ids = append(ids, int64(id))
+	}
+
+	rows, err := DB.Query("SELECT * FROM attachments WHERE message_id = ANY($1) ORDER BY message_id, position, id", pq.Int64Array(ids))
+	if err != nil {
+		return attachments, err
+	}
+	defer rows.Close()
+
+	err = scanMultiAttachments(&attachments, rows)
+
+	return attachments, err
+}
+
+// FindReceivedMessageAttachments returns the attachments of a message if it was
+// received by one of the users devices
+func FindReceivedMessageAttachments(DB *sql.DB, userID uint, messageID uint) ([]Attachment, error) {
+	attachments := []Attachment{}
+
+	rows, err := DB.Query("SELECT attachments.* FROM attachments WHERE attachments.message_id=$2 AND EXISTS (SELECT 1 FROM received_messages JOIN devices ON received_messages.device_id = devices.id WHERE received_messages.message_id = attachments.message_id AND devices.user_id=$1) ORDER BY position, id", userID, messageID)
+	if err != nil {
+		return attachments, err
+	}
+	defer rows.Close()
+
+	err = scanMultiAttachments(&attachments, rows)
+
+	return attachments, err
+}
+
+// loadAttachments sets the Attachments of the messages in their order
+func loadAttachments(DB *sql.DB, msgs []Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	messageIDs := []uint{}
+	for _, msg := range msgs {
+		messageIDs = append(messageIDs, msg.ID)
+	}
+
+	attachments, err := FindAttachmentsByMessages(DB, messageIDs)
+	if err != nil {
+		return err
+	}
+
+	for i := range msgs {
+		msgs[i].Attachments = []Attachment{}
+		for _, a := range attachments {
+			if a.MessageID == msgs[i].ID {
+				msgs[i].Attachments = append(msgs[i].Attachments, a)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Create stores the attachment of a message of the given user. The file name
+// is sealed with the data key of the user if encryption at rest is enabled.
+func (a *Attachment) Create(DB *sql.DB, userID uint) error {
+	a.Sealed = Sealer != nil && Sealer.Enabled()
+
+	fileName := a.FileName
+	if a.Sealed {
+		var err error
+		if fileName, err = Sealer.Seal(userID, a.FileName); err != nil {
+			return err
+		}
+	}
+
+	return DB.QueryRow("INSERT INTO attachments (created_at, message_id, file, file_name, mime_type, size, sha256, position, scan_status, scan_signature, sealed) VALUES (current_timestamp(), $1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id, created_at", a.MessageID, a.File, fileName, a.MimeType, a.Size, a.SHA256, a.Position, a.ScanStatus, a.ScanSignature, a.Sealed).Scan(&a.ID, &a.CreatedAt)
+}
+
+// SetImageInfo stores the dimensions and thumbnail state of an image on all
+// attachments sharing its file
+func SetImageInfo(DB *sql.DB, file string, width int, height int, thumbnail bool) error {
+	_, err := DB.Exec("UPDATE attachments SET width=$2, height=$3, thumbnail=$4 WHERE file=$1", file, width, height, thumbnail)
+	return err
+}
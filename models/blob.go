@@ -0,0 +1,90 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Blob is a stored file which may be shared by several attachments with the
+// same content. References counts these attachments.
+//
+// Files are deduplicated across all users. Clients can't tell: they always
+// upload the whole file and may only reference their own files by hash, see
+// BlobExistsHandler. A shared file stays encrypted with the data key of the
+// user who stored it first, so data keys must not be deleted while files
+// encrypted with them are referenced.
+type Blob struct {
+	File       string
+	CreatedAt  time.Time
+	SHA256     string
+	Size       int64
+	References int
+}
+
+// AcquireBlob adds a reference to the blob with the given hash. If there is no
+// such blob yet, file becomes the blob. Otherwise the returned blob refers to
+// a different, already stored file and the caller should throw away its copy.
+func AcquireBlob(DB *sql.DB, sha256 string, file string, size int64) (Blob, error) {
+	b := Blob{}
+	var hash sql.NullString
+
+	err := DB.QueryRow("INSERT INTO blobs (file, created_at, sha256, size, refs) VALUES ($1, current_timestamp, $2, $3, 1) ON CONFLICT (sha256) DO UPDATE SET refs = blobs.refs + 1 RETURNING file, created_at, sha256, size, refs", file, sha256, size).Scan(&b.File, &b.CreatedAt, &hash, &b.Size, &b.References)
+	b.SHA256 = hash.String
+
+	return b, err
+}
+
+// AcquireExistingBlob adds a reference to the blob stored as file, for
+// attachments reusing a file sent before. Unlike AcquireBlob it never brings
+// back a blob whose last reference is being released; sql.ErrNoRows is
+// returned then.
+func AcquireExistingBlob(DB *sql.DB, file string) (Blob, error) {
+	b := Blob{}
+	var hash sql.NullString
+
+	err := DB.QueryRow("UPDATE blobs SET refs = refs + 1 WHERE file=$1 AND refs>0 RETURNING file, created_at, sha256, size, refs", file).Scan(&b.File, &b.CreatedAt, &hash, &b.Size, &b.References)
+	b.SHA256 = hash.String
+
+	return b, err
+}
+
+// ReleaseBlob drops a reference to the blob stored as file. It returns true if
+// that was the last reference; the file should be deleted then. The row stays
+// locked until it is gone, so concurrent releases and acquisitions see either
+// the old or the final state.
+func ReleaseBlob(DB *sql.DB, file string) (bool, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	var refs int
+	err = tx.QueryRow("UPDATE blobs SET refs = refs - 1 WHERE file=$1 RETURNING refs", file).Scan(&refs)
+	if err == sql.ErrNoRows {
+		// A file without any blob entry was never shared
+		tx.Rollback()
+		return true, nil
+	}
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	if refs > 0 {
+		return false, tx.Commit()
+	}
+
+	if _, err := tx.Exec("DELETE FROM blobs WHERE file=$1", file); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// IsBlob reports whether file is referenced as a blob by any attachment
+func IsBlob(DB *sql.DB, file string) (bool, error) {
+	var exists bool
+	err := DB.QueryRow("SELECT EXISTS(SELECT 1 FROM blobs WHERE file=$1)", file).Scan(&exists)
+	return exists, err
+}
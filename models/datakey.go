@@ -0,0 +1,77 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// DataKey encrypts the messages and files of a user. It is only stored wrapped
+// with the master key, MasterKeyID tells which one.
+type DataKey struct {
+	ID          uint
+	CreatedAt   time.Time
+	UserID      uint
+	WrappedKey  string
+	MasterKeyID string
+}
+
+// FieldSealer encrypts message contents before they are stored and decrypts
+// them when loading. Unless it is enabled contents are stored in plaintext.
+type FieldSealer interface {
+	Enabled() bool
+	Seal(userID uint, value string) (string, error)
+	Open(value string) (string, error)
+}
+
+var Sealer FieldSealer
+
+func scanDataKey(k *DataKey, row *sql.Row) error {
+	return row.Scan(&k.ID, &k.CreatedAt, &k.UserID, &k.WrappedKey, &k.MasterKeyID)
+}
+
+func FindDataKey(DB *sql.DB, id uint) (DataKey, error) {
+	k := DataKey{}
+	err := scanDataKey(&k, DB.QueryRow("SELECT * FROM data_keys WHERE id=$1", id))
+
+	return k, err
+}
+
+// FindUserDataKey returns the newest data key of the user
+func FindUserDataKey(DB *sql.DB, userID uint) (DataKey, error) {
+	k := DataKey{}
+	err := scanDataKey(&k, DB.QueryRow("SELECT * FROM data_keys WHERE user_id=$1 ORDER BY id DESC LIMIT 1", userID))
+
+	return k, err
+}
+
+// FindDataKeysNotWrappedWith returns all data keys wrapped with a master key
+// other than the given one
+func FindDataKeysNotWrappedWith(DB *sql.DB, masterKeyID string) ([]DataKey, error) {
+	keys := []DataKey{}
+
+	rows, err := DB.Query("SELECT * FROM data_keys WHERE master_key_id<>$1 ORDER BY id", masterKeyID)
+	if err != nil {
+		return keys, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var k DataKey
+		if err := rows.Scan(&k.ID, &k.CreatedAt, &k.UserID, &k.WrappedKey, &k.MasterKeyID); err != nil {
+			return keys, err
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+func (k *DataKey) Create(DB *sql.DB) error {
+	return DB.QueryRow("INSERT INTO data_keys (created_at, user_id, wrapped_key, master_key_id) VALUES (current_timestamp, $1, $2, $3) RETURNING id, created_at", k.UserID, k.WrappedKey, k.MasterKeyID).Scan(&k.ID, &k.CreatedAt)
+}
+
+// Update stores the key after it was wrapped with another master key
+func (k *DataKey) Update(DB *sql.DB) error {
+	_, err := DB.Exec("UPDATE data_keys SET wrapped_key=$2, master_key_id=$3 WHERE id=$1", k.ID, k.WrappedKey, k.MasterKeyID)
+	return err
+}
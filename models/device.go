@@ -29,6 +29,7 @@ type Device struct {
 	UserID           uint
 	Platform         string
 	Name             string
+	PublicKey        string
 	Options          DeviceOptions
 	SentMessages     []Message
 	ReceivedMessages []ReceivedMessage
@@ -39,14 +40,14 @@ func scanDeviceOptions(do *DeviceOptions, row *sql.Row) error {
 }
 
 func scanDevice(d *Device, row *sql.Row) error {
-	return row.Scan(&d.ID, &d.CreatedAt, &d.LastModifiedAt, &d.UserID, &d.Platform, &d.Name)
+	return row.Scan(&d.ID, &d.CreatedAt, &d.LastModifiedAt, &d.UserID, &d.Platform, &d.Name, &d.PublicKey)
 }
 
 func scanDevices(rows *sql.Rows) ([]Device, error) {
 	devices := []Device{}
-	for i := 0; rows.Next(); i++ {
+	for rows.Next() {
 		d := Device{}
-		err := rows.Scan(&devices[i].ID, &devices[i].CreatedAt, &devices[i].LastModifiedAt, &devices[i].UserID, &devices[i].Platform, &devices[i].Name)
+		err := rows.Scan(&d.ID, &d.CreatedAt, &d.LastModifiedAt, &d.UserID, &d.Platform, &d.Name, &d.PublicKey)
 		if err != nil {
 			log.Warn(err)
 			continue
@@ -82,10 +83,10 @@ func FindDevicesByUserID(DB *sql.DB, userID uint) ([]Device, error) {
 			log.WithFields(log.Fields{"user_id": userID, "error": err}).Error("SQL error finding user's devices")
 		}
 
-		rows.Close()
-
 		return []Device{}, err
 	}
+	defer rows.Close()
+
 	devices, err := scanDevices(rows)
 
 	return devices, err
@@ -93,7 +94,17 @@ func FindDevicesByUserID(DB *sql.DB, userID uint) ([]Device, error) {
 
 func (d *Device) Create(DB *sql.DB) error {
 	d.ID = uuid.NewV4().String()
-	return DB.QueryRow("INSERT INTO devices(id, created_at, last_modified_at, user_id, platform, name) VALUES ($1, current_timestamp(), current_timestamp(), $2, $3, $4) RETURNING created_at, last_modified_at", d.ID, d.UserID, d.Platform, d.Name).Scan(&d.CreatedAt, &d.LastModifiedAt)
+	return DB.QueryRow("INSERT INTO devices(id, created_at, last_modified_at, user_id, platform, name, public_key) VALUES ($1, current_timestamp(), current_timestamp(), $2, $3, $4, $5) RETURNING created_at, last_modified_at", d.ID, d.UserID, d.Platform, d.Name, d.PublicKey).Scan(&d.CreatedAt, &d.LastModifiedAt)
+}
+
+// UpdatePublicKey replaces the key messages are encrypted for the device with
+func (d *Device) UpdatePublicKey(DB *sql.DB, publicKey string) error {
+	if err := DB.QueryRow("UPDATE devices SET public_key=$2, last_modified_at=current_timestamp() WHERE id=$1 RETURNING last_modified_at", d.ID, publicKey).Scan(&d.LastModifiedAt); err != nil {
+		return err
+	}
+
+	d.PublicKey = publicKey
+	return nil
 }
 
 func (d *Device) LoadOptions(DB *sql.DB) error {
@@ -2,10 +2,12 @@ package models
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
 
+	"github.com/irrenhaus/pushmearound_server/markdown"
 	"github.com/lib/pq"
 )
 
@@ -13,7 +15,35 @@ const (
 	ContentTypeMessage = iota
 	ContentTypeURL     = iota
 	ContentTypeFile    = iota
-	ContentTypeLast    = iota
+	// The content is encrypted by the sender for the receiving devices
+	ContentTypeEncrypted = iota
+	// Content types with a typed payload, see ValidatePayload
+	ContentTypeChecklist = iota
+	ContentTypeAddress   = iota
+	ContentTypeLocation  = iota
+	ContentTypePhone     = iota
+	// Clipboard entries are synced silently, only the latest ones are kept
+	ContentTypeClipboard = iota
+	ContentTypeLast      = iota
+)
+
+// ContentTypeNames maps the content types to the names used in configuration
+var ContentTypeNames map[uint]string = map[uint]string{
+	ContentTypeMessage:   "message",
+	ContentTypeURL:       "url",
+	ContentTypeFile:      "file",
+	ContentTypeEncrypted: "encrypted",
+	ContentTypeChecklist: "checklist",
+	ContentTypeAddress:   "address",
+	ContentTypeLocation:  "location",
+	ContentTypePhone:     "phone",
+	ContentTypeClipboard: "clipboard",
+}
+
+// Formats of the message text
+const (
+	FormatPlain    = ""
+	FormatMarkdown = "markdown"
 )
 
 type Message struct {
@@ -25,20 +55,201 @@ type Message struct {
 	ContentType    uint
 	Title          string
 	Msg            string
-	URL            string
-	File           string
+	// Format of Msg, markdown messages carry the rendered text in HTML
+	Format string
+	HTML   string
+	URL    string
+	// File and FileName refer to the first attachment for older clients
+	File        string
+	FileName    string
+	Attachments []Attachment
+	// Opaque content of encrypted messages, base64 encoded
+	Ciphertext string
+	// The message key wrapped for the device the message is listed for
+	WrappedKey string
+	// Typed content of checklists, addresses, locations and phone numbers
+	Payload json.RawMessage
+	// Preview of the linked page of URL messages, once it has been fetched
+	Preview json.RawMessage
+	// Actions the receiving devices can answer the message with, see
+	// ValidateActions
+	Actions     json.RawMessage
+	CallbackURL string
+	// Secret the callbacks are signed with, only the sender gets to see it
+	CallbackSecret string `json:"-"`
+	// The action chosen by one of the devices
+	ActionResponse string
+	RespondedAt    pq.NullTime
+	// The message this one replies to, 0 if none. A thread is named after the
+	// message starting it.
+	ReplyTo  uint
+	ThreadID uint
+	// Unread messages in the thread, only set in the list of unread messages
+	ThreadUnread uint
+	// Flags set by the user, archived messages are left out of the unread list
+	Starred  bool
+	Pinned   bool
+	Archived bool
+	// Whether the contents are stored encrypted at rest
+	Sealed bool `json:"-"`
+	// Whether the file name and callback URL are stored encrypted as well.
+	// Messages sealed before they were keep them in plaintext.
+	MetadataSealed bool `json:"-"`
 }
 
+// messageColumns lists the columns scanned by scanMessage. The messages table
+// also carries a search_vector column which must never be selected.
+const messageColumns = "id, created_at, last_modified_at, user_id, device_id, content_type, title, msg, format, url, file, file_name, ciphertext, payload, preview, actions, callback_url, callback_secret, action_response, responded_at, reply_to, thread_id, starred, pinned, archived, sealed, metadata_sealed"
+
 type ReceivedMessage struct {
 	ID        uint
 	CreatedAt time.Time
 	DeviceID  string
 	MessageID uint
 	Unread    bool
+	Dismissed bool
+	// The message key of encrypted messages, wrapped with the devices public
+	// key
+	WrappedKey string
 }
 
 func scanMessage(msg *Message, rows *sql.Rows) error {
-	return rows.Scan(&msg.ID, &msg.CreatedAt, &msg.LastModifiedAt, &msg.UserID, &msg.DeviceID, &msg.ContentType, &msg.Title, &msg.Msg, &msg.URL, &msg.File)
+	var payload, preview, actions []byte
+	var replyTo sql.NullInt64
+	if err := rows.Scan(&msg.ID, &msg.CreatedAt, &msg.LastModifiedAt, &msg.UserID, &msg.DeviceID, &msg.ContentType, &msg.Title, &msg.Msg, &msg.Format, &msg.URL, &msg.File, &msg.FileName, &msg.Ciphertext, &payload, &preview, &actions, &msg.CallbackURL, &msg.CallbackSecret, &msg.ActionResponse, &msg.RespondedAt, &replyTo, &msg.ThreadID, &msg.Starred, &msg.Pinned, &msg.Archived, &msg.Sealed, &msg.MetadataSealed); err != nil {
+		return err
+	}
+	msg.ReplyTo = uint(replyTo.Int64)
+	msg.Payload = payload
+	msg.Preview = preview
+	msg.Actions = actions
+
+	if err := msg.openFields(); err != nil {
+		return err
+	}
+
+	return msg.renderHTML()
+}
+
+// renderHTML renders markdown messages. The HTML isn't stored so that changes
+// to the sanitizer apply to old messages as well.
+func (msg *Message) renderHTML() error {
+	if msg.Format != FormatMarkdown {
+		return nil
+	}
+
+	html, err := markdown.Render(msg.Msg)
+	if err != nil {
+		return err
+	}
+
+	msg.HTML = html
+	return nil
+}
+
+// openFields decrypts the contents of a message encrypted at rest. Contents
+// of messages stored in plaintext are never touched, whatever they look like.
+func (msg *Message) openFields() error {
+	if !msg.Sealed {
+		return nil
+	}
+
+	if Sealer == nil {
+		return errors.New("Message is encrypted but no sealer is set")
+	}
+
+	fields := []*string{&msg.Title, &msg.Msg, &msg.URL}
+	if msg.MetadataSealed {
+		fields = append(fields, &msg.FileName, &msg.CallbackURL)
+	}
+
+	for _, field := range fields {
+		value, err := Sealer.Open(*field)
+		if err != nil {
+			return err
+		}
+		*field = value
+	}
+
+	for _, field := range []*json.RawMessage{&msg.Payload, &msg.Preview, &msg.Actions} {
+		value, err := openPayload(*field)
+		if err != nil {
+			return err
+		}
+		*field = value
+	}
+
+	return nil
+}
+
+// openPayload decrypts a JSON column of a sealed message. Sealed values are
+// stored as a JSON string.
+func openPayload(payload json.RawMessage) (json.RawMessage, error) {
+	if len(payload) == 0 {
+		return payload, nil
+	}
+
+	var sealed string
+	if err := json.Unmarshal(payload, &sealed); err != nil {
+		return nil, err
+	}
+
+	value, err := Sealer.Open(sealed)
+	return json.RawMessage(value), err
+}
+
+// sealedPayload returns the contents of a JSON column of the message as they
+// are stored
+func (msg *Message) sealedPayload(payload json.RawMessage) (interface{}, error) {
+	if len(payload) == 0 {
+		return nil, nil
+	}
+
+	if !msg.Sealed {
+		return string(payload), nil
+	}
+
+	sealed, err := Sealer.Seal(msg.UserID, string(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, err := json.Marshal(sealed)
+	return string(encoded), err
+}
+
+// sealedFields returns the contents of the message as they are stored
+func (msg *Message) sealedFields() (string, string, string, error) {
+	if !msg.Sealed {
+		return msg.Title, msg.Msg, msg.URL, nil
+	}
+
+	sealed := []string{}
+	for _, value := range []string{msg.Title, msg.Msg, msg.URL} {
+		value, err := Sealer.Seal(msg.UserID, value)
+		if err != nil {
+			return "", "", "", err
+		}
+		sealed = append(sealed, value)
+	}
+
+	return sealed[0], sealed[1], sealed[2], nil
+}
+
+// sealedMetadata returns the file name and callback URL of the message as they
+// are stored
+func (msg *Message) sealedMetadata() (string, string, error) {
+	if !msg.MetadataSealed {
+		return msg.FileName, msg.CallbackURL, nil
+	}
+
+	fileName, err := Sealer.Seal(msg.UserID, msg.FileName)
+	if err != nil {
+		return "", "", err
+	}
+
+	callbackURL, err := Sealer.Seal(msg.UserID, msg.CallbackURL)
+	return fileName, callbackURL, err
 }
 
 func scanMultiMessages(msgs *[]Message, rows *sql.Rows) error {
@@ -55,13 +266,13 @@ func scanMultiMessages(msgs *[]Message, rows *sql.Rows) error {
 }
 
 func scanReceivedMessage(msg *ReceivedMessage, row *sql.Row) error {
-	return row.Scan(&msg.ID, &msg.CreatedAt, &msg.DeviceID, &msg.MessageID, &msg.Unread)
+	return row.Scan(&msg.ID, &msg.CreatedAt, &msg.DeviceID, &msg.MessageID, &msg.Unread, &msg.Dismissed, &msg.WrappedKey)
 }
 
 func scanMultiReceivedMessages(msgs *[]ReceivedMessage, rows *sql.Rows) error {
 	for rows.Next() {
 		var msg ReceivedMessage
-		err := rows.Scan(&msg.ID, &msg.CreatedAt, &msg.DeviceID, &msg.MessageID, &msg.Unread)
+		err := rows.Scan(&msg.ID, &msg.CreatedAt, &msg.DeviceID, &msg.MessageID, &msg.Unread, &msg.Dismissed, &msg.WrappedKey)
 		if err != nil {
 			rows.Close()
 			return err
@@ -73,7 +284,7 @@ func scanMultiReceivedMessages(msgs *[]ReceivedMessage, rows *sql.Rows) error {
 }
 
 func FindMessagesByDevice(DB *sql.DB, deviceID string) ([]Message, error) {
-	query := "SELECT * FROM messages WHERE device_id=$1"
+	query := "SELECT " + messageColumns + " FROM messages WHERE device_id=$1"
 
 	msgs := []Message{}
 	rows, err := DB.Query(query, deviceID)
@@ -87,21 +298,118 @@ func FindMessagesByDevice(DB *sql.DB, deviceID string) ([]Message, error) {
 	return msgs, err
 }
 
+// FindThread returns the messages of the thread the given message of the user
+// belongs to, oldest first
+func FindThread(DB *sql.DB, userID uint, messageID uint) ([]Message, error) {
+	query := "SELECT " + messageColumns + " FROM messages WHERE user_id=$1 AND thread_id=(SELECT thread_id FROM messages WHERE id=$2 AND user_id=$1) ORDER BY id"
+
+	msgs := []Message{}
+	rows, err := DB.Query(query, userID, messageID)
+	if err != nil {
+		return msgs, err
+	}
+	defer rows.Close()
+
+	if err = scanMultiMessages(&msgs, rows); err != nil {
+		return msgs, err
+	}
+
+	if len(msgs) == 0 {
+		return msgs, sql.ErrNoRows
+	}
+
+	err = loadAttachments(DB, msgs)
+
+	return msgs, err
+}
+
 func FindMessageList(DB *sql.DB, messageIDs []uint) ([]Message, error) {
-	query := "SELECT * FROM messages WHERE id IN $2"
+	query := "SELECT " + messageColumns + " FROM messages WHERE id = ANY($1)"
 
 	msgs := []Message{}
 
-	rows, err := DB.Query(query, messageIDs)
+	ids := []int64{}
+	for _, id := range messageIDs {
+		ids = append(ids, int64(id))
+	}
+
+	rows, err := DB.Query(query, pq.Int64Array(ids))
 	if err != nil {
 		return msgs, err
 	}
+	defer rows.Close()
+
+	if err = scanMultiMessages(&msgs, rows); err != nil {
+		return msgs, err
+	}
+
+	err = loadAttachments(DB, msgs)
+
+	return msgs, err
+}
+
+func FindMessage(DB *sql.DB, id uint) (Message, error) {
+	query := "SELECT " + messageColumns + " FROM messages WHERE id=$1"
+
+	msg := Message{}
+	rows, err := DB.Query(query, id)
+	if err != nil {
+		return msg, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return msg, err
+		}
+		return msg, sql.ErrNoRows
+	}
+
+	err = scanMessage(&msg, rows)
+
+	return msg, err
+}
+
+// FindMessagesOlderThan finds the messages of a content type created more
+// than the given number of days ago. Messages only record the day they were
+// created on, so the age is counted in whole days.
+func FindMessagesOlderThan(DB *sql.DB, contentType uint, days uint) ([]Message, error) {
+	query := "SELECT " + messageColumns + " FROM messages WHERE content_type=$1 AND created_at < current_date - $2::integer ORDER BY id"
+
+	msgs := []Message{}
+	rows, err := DB.Query(query, contentType, days)
+	if err != nil {
+		return msgs, err
+	}
+	defer rows.Close()
 
 	err = scanMultiMessages(&msgs, rows)
 
 	return msgs, err
 }
 
+// FindReferencedFiles returns the keys of all stored files still in use by a
+// message, an attachment or a resumable upload
+func FindReferencedFiles(DB *sql.DB) (map[string]bool, error) {
+	files := map[string]bool{}
+
+	rows, err := DB.Query("SELECT file FROM messages WHERE file IS NOT NULL AND file <> '' UNION SELECT file FROM attachments UNION SELECT file FROM blobs UNION SELECT id FROM uploads")
+	if err != nil {
+		return files, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var file string
+		if err := rows.Scan(&file); err != nil {
+			return files, err
+		}
+		files[file] = true
+	}
+
+	return files, rows.Err()
+}
+
 func FindReceivedMessage(DB *sql.DB, id uint) (ReceivedMessage, error) {
 	query := "SELECT * FROM received_messages WHERE id=$1"
 
@@ -124,6 +432,17 @@ func FindReceivedMessageByMessage(DB *sql.DB, msgID uint) (ReceivedMessage, erro
 	return msg, err
 }
 
+func FindReceivedMessageByMessageAndDevice(DB *sql.DB, msgID uint, deviceID string) (ReceivedMessage, error) {
+	query := "SELECT * FROM received_messages WHERE message_id=$1 AND device_id=$2"
+
+	row := DB.QueryRow(query, msgID, deviceID)
+
+	msg := ReceivedMessage{}
+	err := scanReceivedMessage(&msg, row)
+
+	return msg, err
+}
+
 func FindReceivedMessagesByDevice(DB *sql.DB, deviceID string) ([]ReceivedMessage, error) {
 	query := "SELECT * FROM received_messages WHERE device_id=$1"
 
@@ -140,7 +459,55 @@ func FindReceivedMessagesByDevice(DB *sql.DB, deviceID string) ([]ReceivedMessag
 }
 
 func (msg *Message) Create(DB *sql.DB) error {
-	return DB.QueryRow("INSERT INTO messages(created_at, last_modified_at, user_id, device_id, content_type, title, msg, url, file) VALUES (current_timestamp(), current_timestamp(), $1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at, last_modified_at", msg.UserID, msg.DeviceID, msg.ContentType, msg.Title, msg.Msg, msg.URL, msg.File).Scan(&msg.ID, &msg.CreatedAt, &msg.LastModifiedAt)
+	// A message is sealed as a whole, so that messages stored before the
+	// master key was set can still be told apart from sealed ones
+	msg.Sealed = Sealer != nil && Sealer.Enabled()
+	msg.MetadataSealed = msg.Sealed
+
+	title, text, url, err := msg.sealedFields()
+	if err != nil {
+		return err
+	}
+
+	fileName, callbackURL, err := msg.sealedMetadata()
+	if err != nil {
+		return err
+	}
+
+	payload, err := msg.sealedPayload(msg.Payload)
+	if err != nil {
+		return err
+	}
+
+	actions, err := msg.sealedPayload(msg.Actions)
+	if err != nil {
+		return err
+	}
+
+	if err := msg.renderHTML(); err != nil {
+		return err
+	}
+
+	// The ID is needed up front, a message starting a thread names it
+	var id uint
+	if err := DB.QueryRow("SELECT nextval(pg_get_serial_sequence('messages', 'id'))").Scan(&id); err != nil {
+		return err
+	}
+
+	threadID := msg.ThreadID
+	if threadID == 0 {
+		threadID = id
+	}
+
+	replyTo := sql.NullInt64{Int64: int64(msg.ReplyTo), Valid: msg.ReplyTo != 0}
+
+	if err := DB.QueryRow("INSERT INTO messages(id, created_at, last_modified_at, user_id, device_id, content_type, title, msg, format, url, file, file_name, ciphertext, payload, actions, callback_url, callback_secret, reply_to, thread_id, sealed, metadata_sealed) VALUES ($1, current_timestamp(), current_timestamp(), $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19) RETURNING created_at, last_modified_at", id, msg.UserID, msg.DeviceID, msg.ContentType, title, text, msg.Format, url, msg.File, fileName, msg.Ciphertext, payload, actions, callbackURL, msg.CallbackSecret, replyTo, threadID, msg.Sealed, msg.MetadataSealed).Scan(&msg.CreatedAt, &msg.LastModifiedAt); err != nil {
+		return err
+	}
+
+	msg.ID = id
+	msg.ThreadID = threadID
+	return nil
 }
 
 func (msg *Message) Delete(DB *sql.DB) error {
@@ -166,8 +533,65 @@ func (msg *Message) Delete(DB *sql.DB) error {
 	return nil
 }
 
+// Recall deletes the message together with all of its deliveries and
+// attachments. The deleted attachments are left in msg.Attachments.
+func (msg *Message) Recall(DB *sql.DB) error {
+	if msg.ID == 0 {
+		return errors.New("Message object has no ID")
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM received_messages WHERE message_id=$1", msg.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// The caller needs the attachments to release their files
+	rows, err := tx.Query("DELETE FROM attachments WHERE message_id=$1 RETURNING *", msg.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	attachments := []Attachment{}
+	if err := scanMultiAttachments(&attachments, rows); err != nil {
+		rows.Close()
+		tx.Rollback()
+		return err
+	}
+	rows.Close()
+
+	res, err := tx.Exec("DELETE FROM messages WHERE id=$1", msg.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if affected <= 0 {
+		tx.Rollback()
+		return errors.New("No such database entry")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	msg.Attachments = attachments
+	return nil
+}
+
 func FindUnreadReceivedMessagesByDevice(DB *sql.DB, deviceID string) ([]ReceivedMessage, error) {
-	query := "SELECT * FROM received_messages WHERE device_id=$1 AND unread=false"
+	query := "SELECT * FROM received_messages WHERE device_id=$1 AND unread=true"
 
 	msgs := []ReceivedMessage{}
 	rows, err := DB.Query(query, deviceID)
@@ -182,7 +606,7 @@ func FindUnreadReceivedMessagesByDevice(DB *sql.DB, deviceID string) ([]Received
 }
 
 func FindUnreadReceivedMessagesByUser(DB *sql.DB, userID uint) ([]ReceivedMessage, error) {
-	query := "SELECT * FROM received_messages JOIN devices on received_messages.device_id = devices.id WHERE devices.user_id=$1 AND unread=false"
+	query := "SELECT received_messages.* FROM received_messages JOIN devices on received_messages.device_id = devices.id WHERE devices.user_id=$1 AND unread=true"
 
 	msgs := []ReceivedMessage{}
 	rows, err := DB.Query(query, userID)
@@ -197,7 +621,7 @@ func FindUnreadReceivedMessagesByUser(DB *sql.DB, userID uint) ([]ReceivedMessag
 }
 
 func (rm *ReceivedMessage) Create(DB *sql.DB) error {
-	return DB.QueryRow("INSERT INTO received_messages(created_at, device_id, message_id, unread) VALUES (current_timestamp(), $1, $2, true) RETURNING id, created_at, unread", rm.DeviceID, rm.MessageID).Scan(&rm.ID, &rm.CreatedAt, &rm.Unread)
+	return DB.QueryRow("INSERT INTO received_messages(created_at, device_id, message_id, unread, wrapped_key) VALUES (current_timestamp(), $1, $2, true, $3) RETURNING id, created_at, unread, dismissed", rm.DeviceID, rm.MessageID, rm.WrappedKey).Scan(&rm.ID, &rm.CreatedAt, &rm.Unread, &rm.Dismissed)
 }
 
 func (rm *ReceivedMessage) Delete(DB *sql.DB) error {
@@ -205,7 +629,7 @@ func (rm *ReceivedMessage) Delete(DB *sql.DB) error {
 		return errors.New("ReceivedMessage object has no ID")
 	}
 
-	res, err := DB.Exec("DELETE FROM messages WHERE id=$1", rm.ID)
+	res, err := DB.Exec("DELETE FROM received_messages WHERE id=$1", rm.ID)
 
 	if err != nil {
 		return err
@@ -224,6 +648,533 @@ func (rm *ReceivedMessage) Delete(DB *sql.DB) error {
 }
 
 func (msg *ReceivedMessage) Update(DB *sql.DB) error {
-	_, err := DB.Exec("UPDATE messages SET unread=$2 WHERE id=$1", msg.ID, msg.Unread)
+	_, err := DB.Exec("UPDATE received_messages SET unread=$2 WHERE id=$1", msg.ID, msg.Unread)
 	return err
 }
+
+// MessageHistoryFilter narrows down the messages returned by
+// FindMessageHistory. Zero values mean "don't filter".
+type MessageHistoryFilter struct {
+	// Before is the pagination cursor: only messages with a smaller ID are
+	// returned
+	Before         uint
+	Limit          uint
+	DeviceID       string
+	SenderDeviceID string
+	ContentType    *uint
+	// Messages created from Since on and before Until
+	Since time.Time
+	Until time.Time
+	// Clipboard entries are left out unless asked for
+	IncludeClipboard bool
+	// Flags the messages must have or not have, nil means "don't filter"
+	Starred  *bool
+	Pinned   *bool
+	Archived *bool
+}
+
+// MessageHistoryEntry is a message together with the delivery state on each
+// of the user's devices that received it
+type MessageHistoryEntry struct {
+	Message  Message
+	Received []ReceivedMessage
+}
+
+// FindMessageHistory returns the messages received by any of the user's
+// devices, newest first, together with their per-device state.
+func FindMessageHistory(DB *sql.DB, userID uint, filter MessageHistoryFilter) ([]MessageHistoryEntry, error) {
+	entries := []MessageHistoryEntry{}
+
+	args := []interface{}{userID}
+	receivedCond := "devices.user_id=$1"
+	if filter.DeviceID != "" {
+		args = append(args, filter.DeviceID)
+		receivedCond += fmt.Sprintf(" AND received_messages.device_id=$%d", len(args))
+	}
+
+	query := "SELECT " + messageColumns + " FROM messages WHERE id IN (SELECT received_messages.message_id FROM received_messages JOIN devices ON received_messages.device_id = devices.id WHERE " + receivedCond + ")"
+
+	if filter.Before > 0 {
+		args = append(args, filter.Before)
+		query += fmt.Sprintf(" AND id<$%d", len(args))
+	}
+
+	query, args = filter.appendConditions(query, args)
+
+	args = append(args, filter.Limit)
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d", len(args))
+
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+
+	msgs := []Message{}
+	if err := scanMultiMessages(&msgs, rows); err != nil {
+		return entries, err
+	}
+
+	return buildMessageHistory(DB, userID, msgs)
+}
+
+// appendConditions adds the filters which only depend on the messages table
+// itself to the WHERE clause of query
+func (filter MessageHistoryFilter) appendConditions(query string, args []interface{}) (string, []interface{}) {
+	if filter.SenderDeviceID != "" {
+		args = append(args, filter.SenderDeviceID)
+		query += fmt.Sprintf(" AND device_id=$%d", len(args))
+	}
+
+	if filter.ContentType != nil {
+		args = append(args, *filter.ContentType)
+		query += fmt.Sprintf(" AND content_type=$%d", len(args))
+	} else if !filter.IncludeClipboard {
+		args = append(args, ContentTypeClipboard)
+		query += fmt.Sprintf(" AND content_type<>$%d", len(args))
+	}
+
+	if !filter.Since.IsZero() {
+		args = append(args, filter.Since)
+		query += fmt.Sprintf(" AND created_at>=$%d", len(args))
+	}
+
+	if !filter.Until.IsZero() {
+		args = append(args, filter.Until)
+		query += fmt.Sprintf(" AND created_at<$%d", len(args))
+	}
+
+	flags := []struct {
+		column string
+		value  *bool
+	}{
+		{"starred", filter.Starred},
+		{"pinned", filter.Pinned},
+		{"archived", filter.Archived},
+	}
+
+	for _, flag := range flags {
+		if flag.value != nil {
+			args = append(args, *flag.value)
+			query += fmt.Sprintf(" AND %s=$%d", flag.column, len(args))
+		}
+	}
+
+	return query, args
+}
+
+func buildMessageHistory(DB *sql.DB, userID uint, msgs []Message) ([]MessageHistoryEntry, error) {
+	entries := []MessageHistoryEntry{}
+	if len(msgs) == 0 {
+		return entries, nil
+	}
+
+	if err := loadAttachments(DB, msgs); err != nil {
+		return entries, err
+	}
+
+	messageIDs := []int64{}
+	for _, msg := range msgs {
+		messageIDs = append(messageIDs, int64(msg.ID))
+	}
+
+	received, err := findReceivedMessagesByUserAndMessages(DB, userID, messageIDs)
+	if err != nil {
+		return entries, err
+	}
+
+	for _, msg := range msgs {
+		entry := MessageHistoryEntry{
+			Message:  msg,
+			Received: []ReceivedMessage{},
+		}
+
+		for _, rm := range received {
+			if rm.MessageID == msg.ID {
+				entry.Received = append(entry.Received, rm)
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// MessageSearchCursor points behind the last result of a search page. Results
+// are ordered by rank first and message ID second.
+type MessageSearchCursor struct {
+	Rank float64
+	ID   uint
+}
+
+type MessageSearchResult struct {
+	MessageHistoryEntry
+	Rank    float64
+	Snippet string
+}
+
+// SearchMessages runs a full-text search over the title, text, URL and file
+// name of the messages sent by the user. The Before field of the filter is
+// ignored, searches are paginated using the cursor instead. Messages encrypted
+// at rest can't be found, except for those sealed before their file names
+// were. These can be found by their file name.
+func SearchMessages(DB *sql.DB, userID uint, search string, filter MessageHistoryFilter, cursor *MessageSearchCursor) ([]MessageSearchResult, error) {
+	results := []MessageSearchResult{}
+
+	// ts_rank returns a real. As float8 the rank survives the round trip
+	// through the cursor and compares equal to the row it was taken from.
+	args := []interface{}{userID, search}
+	inner := "SELECT " + messageColumns + ", query, ts_rank(search_vector, query)::float8 AS rank FROM messages, plainto_tsquery('simple', $2) AS query WHERE user_id=$1 AND search_vector @@ query"
+
+	if filter.DeviceID != "" {
+		args = append(args, filter.DeviceID)
+		inner += fmt.Sprintf(" AND id IN (SELECT message_id FROM received_messages WHERE device_id=$%d)", len(args))
+	}
+
+	inner, args = filter.appendConditions(inner, args)
+
+	// Sealed messages only match by a plaintext file name, their other
+	// columns would make for a snippet of ciphertext
+	query := "SELECT " + messageColumns + ", rank, ts_headline('simple', CASE WHEN metadata_sealed THEN '' WHEN sealed THEN file_name ELSE concat_ws(' ', title, msg, url, file_name) END, query) FROM (" + inner + ") AS matches"
+
+	if cursor != nil {
+		args = append(args, cursor.Rank, cursor.ID)
+		query += fmt.Sprintf(" WHERE rank<$%d OR (rank=$%d AND id<$%d)", len(args)-1, len(args)-1, len(args))
+	}
+
+	args = append(args, filter.Limit)
+	query += fmt.Sprintf(" ORDER BY rank DESC, id DESC LIMIT $%d", len(args))
+
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+
+	msgs := []Message{}
+	for rows.Next() {
+		var result MessageSearchResult
+		var payload, preview, actions []byte
+		var replyTo sql.NullInt64
+		msg := &result.Message
+		err := rows.Scan(&msg.ID, &msg.CreatedAt, &msg.LastModifiedAt, &msg.UserID, &msg.DeviceID, &msg.ContentType, &msg.Title, &msg.Msg, &msg.Format, &msg.URL, &msg.File, &msg.FileName, &msg.Ciphertext, &payload, &preview, &actions, &msg.CallbackURL, &msg.CallbackSecret, &msg.ActionResponse, &msg.RespondedAt, &replyTo, &msg.ThreadID, &msg.Starred, &msg.Pinned, &msg.Archived, &msg.Sealed, &msg.MetadataSealed, &result.Rank, &result.Snippet)
+		if err != nil {
+			return results, err
+		}
+		msg.ReplyTo = uint(replyTo.Int64)
+		msg.Payload = payload
+		msg.Preview = preview
+		msg.Actions = actions
+
+		if err := msg.openFields(); err != nil {
+			return results, err
+		}
+
+		if err := msg.renderHTML(); err != nil {
+			return results, err
+		}
+
+		results = append(results, result)
+		msgs = append(msgs, result.Message)
+	}
+
+	if err := rows.Err(); err != nil {
+		return results, err
+	}
+
+	entries, err := buildMessageHistory(DB, userID, msgs)
+	if err != nil {
+		return results, err
+	}
+
+	for i := range results {
+		results[i].MessageHistoryEntry = entries[i]
+	}
+
+	return results, nil
+}
+
+func findReceivedMessagesByUserAndMessages(DB *sql.DB, userID uint, messageIDs []int64) ([]ReceivedMessage, error) {
+	query := "SELECT received_messages.* FROM received_messages JOIN devices ON received_messages.device_id = devices.id WHERE devices.user_id=$1 AND received_messages.message_id = ANY($2) ORDER BY received_messages.id"
+
+	msgs := []ReceivedMessage{}
+	rows, err := DB.Query(query, userID, pq.Int64Array(messageIDs))
+	if err != nil {
+		return msgs, err
+	}
+	defer rows.Close()
+
+	err = scanMultiReceivedMessages(&msgs, rows)
+
+	return msgs, err
+}
+
+// DismissReceivedMessages marks the message as dismissed on all devices of the
+// user. It returns sql.ErrNoRows if none of them received the message.
+func DismissReceivedMessages(DB *sql.DB, userID uint, msgID uint) error {
+	res, err := DB.Exec("UPDATE received_messages SET dismissed=true FROM devices WHERE received_messages.device_id = devices.id AND devices.user_id=$1 AND received_messages.message_id=$2", userID, msgID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected <= 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+var ErrUnknownMessages = errors.New("Some of the messages were not received by any of your devices")
+
+// ReadStateUpdate describes a bulk change of the unread flag of the received
+// messages of a user. DeviceID, MessageIDs and UpToMessageID narrow down the
+// affected messages, zero values mean "don't filter".
+type ReadStateUpdate struct {
+	UserID        uint
+	DeviceID      string
+	MessageIDs    []uint
+	UpToMessageID uint
+	Unread        bool
+}
+
+// UpdateReadState applies the update in a single transaction and returns the
+// IDs of the messages whose state actually changed. If MessageIDs contains a
+// message the user (or the given device) never received nothing is changed
+// and ErrUnknownMessages returned.
+func UpdateReadState(DB *sql.DB, update ReadStateUpdate) ([]uint, error) {
+	changed := []uint{}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return changed, err
+	}
+
+	args := []interface{}{update.UserID, update.Unread}
+	cond := "received_messages.device_id = devices.id AND devices.user_id=$1"
+
+	if update.DeviceID != "" {
+		args = append(args, update.DeviceID)
+		cond += fmt.Sprintf(" AND received_messages.device_id=$%d", len(args))
+	}
+
+	if update.MessageIDs != nil {
+		ids := []int64{}
+		for _, id := range update.MessageIDs {
+			ids = append(ids, int64(id))
+		}
+
+		args = append(args, pq.Int64Array(ids))
+		cond += fmt.Sprintf(" AND received_messages.message_id = ANY($%d)", len(args))
+
+		// With a device given, the messages have to be received by that
+		// device
+		countQuery := "SELECT count(DISTINCT received_messages.message_id) FROM received_messages JOIN devices ON received_messages.device_id = devices.id WHERE devices.user_id=$1 AND received_messages.message_id = ANY($2)"
+		countArgs := []interface{}{update.UserID, pq.Int64Array(ids)}
+		if update.DeviceID != "" {
+			countArgs = append(countArgs, update.DeviceID)
+			countQuery += " AND received_messages.device_id=$3"
+		}
+
+		var found int
+		err := tx.QueryRow(countQuery, countArgs...).Scan(&found)
+		if err != nil {
+			tx.Rollback()
+			return changed, err
+		}
+
+		if found != len(uniqueIDs(update.MessageIDs)) {
+			tx.Rollback()
+			return changed, ErrUnknownMessages
+		}
+	}
+
+	if update.UpToMessageID > 0 {
+		args = append(args, update.UpToMessageID)
+		cond += fmt.Sprintf(" AND received_messages.message_id<=$%d", len(args))
+	}
+
+	rows, err := tx.Query("UPDATE received_messages SET unread=$2 FROM devices WHERE "+cond+" AND received_messages.unread<>$2 RETURNING received_messages.message_id", args...)
+	if err != nil {
+		tx.Rollback()
+		return changed, err
+	}
+
+	seen := map[uint]bool{}
+	for rows.Next() {
+		var id uint
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return changed, err
+		}
+
+		if !seen[id] {
+			seen[id] = true
+			changed = append(changed, id)
+		}
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return changed, err
+	}
+
+	return changed, tx.Commit()
+}
+
+func uniqueIDs(ids []uint) []uint {
+	seen := map[uint]bool{}
+	unique := []uint{}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+
+	return unique
+}
+
+var ErrNoSuchChecklistItem = errors.New("No such checklist item")
+
+// UpdateChecklistItem sets the checked state of an item of a checklist sent by
+// the user. The payload is rewritten as a whole inside a transaction so that
+// concurrent updates of different items don't get lost.
+func UpdateChecklistItem(DB *sql.DB, userID uint, messageID uint, item int, checked bool) (Message, error) {
+	msg := Message{}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return msg, err
+	}
+
+	rows, err := tx.Query("SELECT "+messageColumns+" FROM messages WHERE id=$1 AND user_id=$2 AND content_type=$3 FOR UPDATE", messageID, userID, ContentTypeChecklist)
+	if err != nil {
+		tx.Rollback()
+		return msg, err
+	}
+
+	found := rows.Next()
+	if found {
+		err = scanMessage(&msg, rows)
+	} else {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	if err != nil {
+		tx.Rollback()
+		return msg, err
+	}
+
+	if !found {
+		tx.Rollback()
+		return msg, sql.ErrNoRows
+	}
+
+	var checklist ChecklistPayload
+	if err := json.Unmarshal(msg.Payload, &checklist); err != nil {
+		tx.Rollback()
+		return msg, err
+	}
+
+	if item < 0 || item >= len(checklist.Items) {
+		tx.Rollback()
+		return msg, ErrNoSuchChecklistItem
+	}
+
+	checklist.Items[item].Checked = checked
+	if msg.Payload, err = json.Marshal(checklist); err != nil {
+		tx.Rollback()
+		return msg, err
+	}
+
+	payload, err := msg.sealedPayload(msg.Payload)
+	if err != nil {
+		tx.Rollback()
+		return msg, err
+	}
+
+	if err := tx.QueryRow("UPDATE messages SET payload=$2, last_modified_at=current_timestamp() WHERE id=$1 RETURNING last_modified_at", msg.ID, payload).Scan(&msg.LastModifiedAt); err != nil {
+		tx.Rollback()
+		return msg, err
+	}
+
+	return msg, tx.Commit()
+}
+
+// FindClipboardMessages returns the latest clipboard entries of the user,
+// newest first
+func FindClipboardMessages(DB *sql.DB, userID uint, limit uint) ([]Message, error) {
+	return findClipboardMessages(DB, "SELECT "+messageColumns+" FROM messages WHERE user_id=$1 AND content_type=$2 ORDER BY id DESC LIMIT $3", userID, ContentTypeClipboard, limit)
+}
+
+// FindOutdatedClipboardMessages returns the clipboard entries of the user
+// beyond the latest keep ones
+func FindOutdatedClipboardMessages(DB *sql.DB, userID uint, keep uint) ([]Message, error) {
+	return findClipboardMessages(DB, "SELECT "+messageColumns+" FROM messages WHERE user_id=$1 AND content_type=$2 ORDER BY id DESC OFFSET $3", userID, ContentTypeClipboard, keep)
+}
+
+func findClipboardMessages(DB *sql.DB, query string, args ...interface{}) ([]Message, error) {
+	msgs := []Message{}
+
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return msgs, err
+	}
+	defer rows.Close()
+
+	if err := scanMultiMessages(&msgs, rows); err != nil {
+		return msgs, err
+	}
+
+	err = loadAttachments(DB, msgs)
+
+	return msgs, err
+}
+
+// SetMessagePreview stores the link preview of a message
+func SetMessagePreview(DB *sql.DB, msg *Message, preview json.RawMessage) error {
+	stored, err := msg.sealedPayload(preview)
+	if err != nil {
+		return err
+	}
+
+	if err := DB.QueryRow("UPDATE messages SET preview=$2, last_modified_at=current_timestamp() WHERE id=$1 RETURNING last_modified_at", msg.ID, stored).Scan(&msg.LastModifiedAt); err != nil {
+		return err
+	}
+
+	msg.Preview = preview
+	return nil
+}
+
+// MessageFlags are the flags the user can set on a message
+type MessageFlags struct {
+	Starred  bool
+	Pinned   bool
+	Archived bool
+}
+
+// MessageFlagsUpdate changes the flags of a message, nil means "keep as is"
+type MessageFlagsUpdate struct {
+	Starred  *bool
+	Pinned   *bool
+	Archived *bool
+}
+
+// UpdateMessageFlags applies the update to a message of the user and returns
+// the resulting flags
+func UpdateMessageFlags(DB *sql.DB, userID uint, messageID uint, update MessageFlagsUpdate) (MessageFlags, error) {
+	flags := MessageFlags{}
+
+	err := DB.QueryRow("UPDATE messages SET starred=COALESCE($3, starred), pinned=COALESCE($4, pinned), archived=COALESCE($5, archived), last_modified_at=current_timestamp() WHERE id=$1 AND user_id=$2 RETURNING starred, pinned, archived", messageID, userID, update.Starred, update.Pinned, update.Archived).Scan(&flags.Starred, &flags.Pinned, &flags.Archived)
+
+	return flags, err
+}
@@ -0,0 +1,261 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits for the fields of payloads
+const (
+	maxChecklistItems  = 200
+	maxPayloadTextSize = 1000
+)
+
+type ChecklistItem struct {
+	Text    string `json:"text"`
+	Checked bool   `json:"checked"`
+}
+
+type ChecklistPayload struct {
+	Items []ChecklistItem `json:"items"`
+}
+
+type AddressPayload struct {
+	Name       string `json:"name,omitempty"`
+	Street     string `json:"street,omitempty"`
+	PostalCode string `json:"postal_code,omitempty"`
+	City       string `json:"city,omitempty"`
+	Region     string `json:"region,omitempty"`
+	// ISO 3166-1 alpha-2 country code
+	Country string `json:"country,omitempty"`
+}
+
+// LocationPayload is a WGS84 position. Accuracy is the radius in meters.
+type LocationPayload struct {
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+	Accuracy  float64  `json:"accuracy,omitempty"`
+	Label     string   `json:"label,omitempty"`
+}
+
+// PhonePayload is a phone number in E.164 format, e.g. +4930123456
+type PhonePayload struct {
+	Number string `json:"number"`
+	Label  string `json:"label,omitempty"`
+}
+
+var countryCodeRegexp = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// Separators commonly used when writing phone numbers
+var phoneSeparatorRegexp = regexp.MustCompile(`[\s()./-]`)
+var phoneNumberRegexp = regexp.MustCompile(`^\+[1-9][0-9]{2,14}$`)
+
+// HasPayload reports whether messages of the content type carry a payload
+func HasPayload(contentType uint) bool {
+	_, ok := PayloadSchemas[contentType]
+	return ok
+}
+
+// ValidatePayload checks the payload of a message against its content type
+// and returns it normalized
+func ValidatePayload(contentType uint, raw []byte) (json.RawMessage, error) {
+	var payload interface {
+		validate() error
+	}
+
+	switch contentType {
+	case ContentTypeChecklist:
+		payload = &ChecklistPayload{}
+	case ContentTypeAddress:
+		payload = &AddressPayload{}
+	case ContentTypeLocation:
+		payload = &LocationPayload{}
+	case ContentTypePhone:
+		payload = &PhonePayload{}
+	default:
+		return nil, errors.New("The content type has no payload")
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(payload); err != nil {
+		return nil, fmt.Errorf("Invalid payload: %s", err)
+	}
+
+	if err := payload.validate(); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(payload)
+}
+
+func validatePayloadText(name string, value string) error {
+	if utf8.RuneCountInString(value) > maxPayloadTextSize {
+		return fmt.Errorf("%s is too long", name)
+	}
+
+	return nil
+}
+
+func (p *ChecklistPayload) validate() error {
+	if len(p.Items) == 0 || len(p.Items) > maxChecklistItems {
+		return fmt.Errorf("A checklist needs between 1 and %d items", maxChecklistItems)
+	}
+
+	for i := range p.Items {
+		p.Items[i].Text = strings.TrimSpace(p.Items[i].Text)
+		if p.Items[i].Text == "" {
+			return errors.New("Checklist items need a text")
+		}
+
+		if err := validatePayloadText("Checklist item", p.Items[i].Text); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *AddressPayload) validate() error {
+	p.Country = strings.ToUpper(p.Country)
+	if p.Country != "" && !countryCodeRegexp.MatchString(p.Country) {
+		return errors.New("country has to be an ISO 3166-1 alpha-2 code")
+	}
+
+	fields := map[string]string{
+		"name":        p.Name,
+		"street":      p.Street,
+		"postal_code": p.PostalCode,
+		"city":        p.City,
+		"region":      p.Region,
+	}
+
+	empty := true
+	for name, value := range fields {
+		if err := validatePayloadText(name, value); err != nil {
+			return err
+		}
+
+		if strings.TrimSpace(value) != "" {
+			empty = false
+		}
+	}
+
+	if empty {
+		return errors.New("An address needs a name, street, postal code, city or region")
+	}
+
+	return nil
+}
+
+func (p *LocationPayload) validate() error {
+	if p.Latitude == nil || p.Longitude == nil {
+		return errors.New("A location needs latitude and longitude")
+	}
+
+	if math.IsNaN(*p.Latitude) || *p.Latitude < -90 || *p.Latitude > 90 {
+		return errors.New("latitude has to be between -90 and 90")
+	}
+
+	if math.IsNaN(*p.Longitude) || *p.Longitude < -180 || *p.Longitude > 180 {
+		return errors.New("longitude has to be between -180 and 180")
+	}
+
+	if math.IsNaN(p.Accuracy) || p.Accuracy < 0 {
+		return errors.New("accuracy has to be a positive number of meters")
+	}
+
+	return validatePayloadText("label", p.Label)
+}
+
+func (p *PhonePayload) validate() error {
+	number := phoneSeparatorRegexp.ReplaceAllString(p.Number, "")
+	if strings.HasPrefix(number, "00") {
+		number = "+" + number[2:]
+	}
+
+	if !phoneNumberRegexp.MatchString(number) {
+		return errors.New("number has to be an international phone number, e.g. +4930123456")
+	}
+	p.Number = number
+
+	return validatePayloadText("label", p.Label)
+}
+
+// PayloadSchemas holds the JSON schemas of the payloads by content type
+var PayloadSchemas = map[uint]string{
+	ContentTypeChecklist: `{
+  "$schema": "http://json-schema.org/draft-04/schema#",
+  "title": "Checklist",
+  "type": "object",
+  "properties": {
+    "items": {
+      "type": "array",
+      "minItems": 1,
+      "maxItems": 200,
+      "items": {
+        "type": "object",
+        "properties": {
+          "text": {"type": "string", "minLength": 1, "maxLength": 1000},
+          "checked": {"type": "boolean"}
+        },
+        "required": ["text"],
+        "additionalProperties": false
+      }
+    }
+  },
+  "required": ["items"],
+  "additionalProperties": false
+}`,
+	ContentTypeAddress: `{
+  "$schema": "http://json-schema.org/draft-04/schema#",
+  "title": "Address",
+  "type": "object",
+  "properties": {
+    "name": {"type": "string", "maxLength": 1000},
+    "street": {"type": "string", "maxLength": 1000},
+    "postal_code": {"type": "string", "maxLength": 1000},
+    "city": {"type": "string", "maxLength": 1000},
+    "region": {"type": "string", "maxLength": 1000},
+    "country": {"type": "string", "pattern": "^[A-Za-z]{2}$"}
+  },
+  "anyOf": [
+    {"required": ["name"], "properties": {"name": {"pattern": "\\S"}}},
+    {"required": ["street"], "properties": {"street": {"pattern": "\\S"}}},
+    {"required": ["postal_code"], "properties": {"postal_code": {"pattern": "\\S"}}},
+    {"required": ["city"], "properties": {"city": {"pattern": "\\S"}}},
+    {"required": ["region"], "properties": {"region": {"pattern": "\\S"}}}
+  ],
+  "additionalProperties": false
+}`,
+	ContentTypeLocation: `{
+  "$schema": "http://json-schema.org/draft-04/schema#",
+  "title": "Location",
+  "type": "object",
+  "properties": {
+    "latitude": {"type": "number", "minimum": -90, "maximum": 90},
+    "longitude": {"type": "number", "minimum": -180, "maximum": 180},
+    "accuracy": {"type": "number", "minimum": 0, "description": "Radius in meters"},
+    "label": {"type": "string", "maxLength": 1000}
+  },
+  "required": ["latitude", "longitude"],
+  "additionalProperties": false
+}`,
+	ContentTypePhone: `{
+  "$schema": "http://json-schema.org/draft-04/schema#",
+  "title": "Phone number",
+  "type": "object",
+  "properties": {
+    "number": {"type": "string", "description": "International number, separators are removed"},
+    "label": {"type": "string", "maxLength": 1000}
+  },
+  "required": ["number"],
+  "additionalProperties": false
+}`,
+}
@@ -0,0 +1,161 @@
+package models
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestValidatePayloadNormalizes(t *testing.T) {
+	for _, test := range []struct {
+		contentType uint
+		raw         string
+		normalized  string
+	}{
+		{ContentTypeChecklist, `{"items": [{"text": " milk "}, {"text": "eggs", "checked": true}]}`, `{"items":[{"text":"milk","checked":false},{"text":"eggs","checked":true}]}`},
+		{ContentTypeAddress, `{"city": "Berlin", "country": "de"}`, `{"city":"Berlin","country":"DE"}`},
+		{ContentTypeLocation, `{"latitude": 52.5, "longitude": 13.4}`, `{"latitude":52.5,"longitude":13.4}`},
+		{ContentTypeLocation, `{"latitude": -90, "longitude": 180, "accuracy": 25, "label": "Pole"}`, `{"latitude":-90,"longitude":180,"accuracy":25,"label":"Pole"}`},
+		{ContentTypePhone, `{"number": "+49 (30) 123-456"}`, `{"number":"+4930123456"}`},
+		{ContentTypePhone, `{"number": "0049 30 123456", "label": "Office"}`, `{"number":"+4930123456","label":"Office"}`},
+	} {
+		payload, err := ValidatePayload(test.contentType, []byte(test.raw))
+		if err != nil {
+			t.Errorf("%s rejected: %s", test.raw, err)
+			continue
+		}
+
+		if string(payload) != test.normalized {
+			t.Errorf("%s normalized to %s, want %s", test.raw, payload, test.normalized)
+		}
+	}
+}
+
+func TestValidatePayloadRejects(t *testing.T) {
+	for _, test := range []struct {
+		contentType uint
+		raw         string
+	}{
+		{ContentTypeChecklist, `{"items": []}`},
+		{ContentTypeChecklist, `{"items": [{"text": "  "}]}`},
+		{ContentTypeChecklist, `{"items": [{"text": "` + strings.Repeat("x", maxPayloadTextSize+1) + `"}]}`},
+		{ContentTypeChecklist, `{"items": [` + strings.Repeat(`{"text": "x"},`, maxChecklistItems) + `{"text": "x"}]}`},
+		{ContentTypeChecklist, `{"items": [{"text": "x", "due": "today"}]}`},
+		{ContentTypeAddress, `{}`},
+		{ContentTypeAddress, `{"name": " ", "country": "DE"}`},
+		{ContentTypeAddress, `{"city": "Berlin", "country": "DEU"}`},
+		{ContentTypeAddress, `{"city": "Berlin", "planet": "Earth"}`},
+		{ContentTypeLocation, `{"latitude": 52.5}`},
+		{ContentTypeLocation, `{"latitude": 91, "longitude": 0}`},
+		{ContentTypeLocation, `{"latitude": 0, "longitude": -181}`},
+		{ContentTypeLocation, `{"latitude": 0, "longitude": 0, "accuracy": -1}`},
+		{ContentTypePhone, `{"number": "030 123456"}`},
+		{ContentTypePhone, `{"number": "+0123456"}`},
+		{ContentTypePhone, `{"number": "+49 30 CALL ME"}`},
+		{ContentTypePhone, `{}`},
+		{ContentTypePhone, `[]`},
+		{ContentTypeMessage, `{}`},
+	} {
+		if payload, err := ValidatePayload(test.contentType, []byte(test.raw)); err == nil {
+			t.Errorf("%.60s accepted as %s", test.raw, payload)
+		}
+	}
+}
+
+type testSchema struct {
+	Properties map[string]json.RawMessage
+	Required   []string
+}
+
+// jsonFields lists the JSON names of the fields of a payload and those which
+// are always encoded
+func jsonFields(payload interface{}) (fields []string, required []string) {
+	typ := reflect.TypeOf(payload)
+	for i := 0; i < typ.NumField(); i++ {
+		tag := strings.Split(typ.Field(i).Tag.Get("json"), ",")
+		fields = append(fields, tag[0])
+		if len(tag) == 1 {
+			required = append(required, tag[0])
+		}
+	}
+
+	sort.Strings(fields)
+	sort.Strings(required)
+	return fields, required
+}
+
+// The schemas are published for clients and have to describe what
+// ValidatePayload accepts
+func TestPayloadSchemasMatchPayloads(t *testing.T) {
+	payloads := map[uint]interface{}{
+		ContentTypeChecklist: ChecklistPayload{},
+		ContentTypeAddress:   AddressPayload{},
+		ContentTypeLocation:  LocationPayload{},
+		ContentTypePhone:     PhonePayload{},
+	}
+
+	if len(PayloadSchemas) != len(payloads) {
+		t.Errorf("%d schemas for %d payloads", len(PayloadSchemas), len(payloads))
+	}
+
+	for contentType, payload := range payloads {
+		if !HasPayload(contentType) {
+			t.Errorf("%s has no payload", ContentTypeNames[contentType])
+			continue
+		}
+
+		schema := testSchema{}
+		if err := json.Unmarshal([]byte(PayloadSchemas[contentType]), &schema); err != nil {
+			t.Errorf("Invalid schema for %s: %s", ContentTypeNames[contentType], err)
+			continue
+		}
+
+		properties := []string{}
+		for name := range schema.Properties {
+			properties = append(properties, name)
+		}
+		sort.Strings(properties)
+		sort.Strings(schema.Required)
+
+		fields, required := jsonFields(payload)
+		if !reflect.DeepEqual(properties, fields) {
+			t.Errorf("The schema for %s has the properties %v, the payload %v", ContentTypeNames[contentType], properties, fields)
+		}
+
+		// Checked defaults to false, it needn't be sent
+		if contentType == ContentTypeChecklist {
+			required = []string{"items"}
+		}
+		if !reflect.DeepEqual(schema.Required, required) {
+			t.Errorf("The schema for %s requires %v, the payload %v", ContentTypeNames[contentType], schema.Required, required)
+		}
+	}
+}
+
+func TestChecklistSchemaLimits(t *testing.T) {
+	schema := struct {
+		Properties struct {
+			Items struct {
+				MinItems int
+				MaxItems int
+				Items    struct {
+					Properties struct {
+						Text struct {
+							MaxLength int
+						}
+					}
+				}
+			}
+		}
+	}{}
+	if err := json.Unmarshal([]byte(PayloadSchemas[ContentTypeChecklist]), &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	items := schema.Properties.Items
+	if items.MinItems != 1 || items.MaxItems != maxChecklistItems || items.Items.Properties.Text.MaxLength != maxPayloadTextSize {
+		t.Errorf("The checklist schema limits %+v differ from the validator", items)
+	}
+}
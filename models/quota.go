@@ -0,0 +1,97 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+type Plan struct {
+	ID              uint
+	CreatedAt       time.Time
+	Name            string
+	MaxStorageBytes sql.NullInt64
+	MaxFiles        sql.NullInt64
+}
+
+// StorageUsage is what a user currently stores in attachments
+type StorageUsage struct {
+	Bytes int64
+	Files int64
+}
+
+// StorageLimits are the effective quotas of a user. Invalid (NULL) values
+// mean unlimited.
+type StorageLimits struct {
+	Plan     string
+	MaxBytes sql.NullInt64
+	MaxFiles sql.NullInt64
+}
+
+func FindPlan(DB *sql.DB, id uint) (Plan, error) {
+	p := Plan{}
+	err := DB.QueryRow("SELECT * FROM plans WHERE id=$1", id).Scan(&p.ID, &p.CreatedAt, &p.Name, &p.MaxStorageBytes, &p.MaxFiles)
+
+	return p, err
+}
+
+// StorageLimits combines the limits of the users plan with the per user
+// overrides
+func (u *User) StorageLimits(DB *sql.DB) (StorageLimits, error) {
+	plan, err := FindPlan(DB, u.PlanID)
+	if err != nil {
+		return StorageLimits{}, err
+	}
+
+	limits := StorageLimits{
+		Plan:     plan.Name,
+		MaxBytes: plan.MaxStorageBytes,
+		MaxFiles: plan.MaxFiles,
+	}
+
+	if u.MaxStorageBytes.Valid {
+		limits.MaxBytes = u.MaxStorageBytes
+	}
+
+	if u.MaxFiles.Valid {
+		limits.MaxFiles = u.MaxFiles
+	}
+
+	return limits, nil
+}
+
+// RemainingBytes returns how many bytes may still be stored and whether there
+// is a limit at all
+func (l StorageLimits) RemainingBytes(usage StorageUsage) (int64, bool) {
+	if !l.MaxBytes.Valid {
+		return 0, false
+	}
+
+	remaining := l.MaxBytes.Int64 - usage.Bytes
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	return remaining, true
+}
+
+// Allows checks whether another file of the given size fits into the quota
+func (l StorageLimits) Allows(usage StorageUsage, size int64) bool {
+	if l.MaxFiles.Valid && usage.Files+1 > l.MaxFiles.Int64 {
+		return false
+	}
+
+	if l.MaxBytes.Valid && usage.Bytes+size > l.MaxBytes.Int64 {
+		return false
+	}
+
+	return true
+}
+
+// RecomputeStorageUsage sums up the attachments of the users messages and
+// caches the result in the users table
+func RecomputeStorageUsage(DB *sql.DB, userID uint) (StorageUsage, error) {
+	usage := StorageUsage{}
+	err := DB.QueryRow("UPDATE users SET storage_bytes = (SELECT coalesce(sum(attachments.size), 0) FROM attachments JOIN messages ON attachments.message_id = messages.id WHERE messages.user_id=$1), storage_files = (SELECT count(*) FROM attachments JOIN messages ON attachments.message_id = messages.id WHERE messages.user_id=$1) WHERE id=$1 RETURNING storage_bytes, storage_files", userID).Scan(&usage.Bytes, &usage.Files)
+
+	return usage, err
+}
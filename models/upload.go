@@ -0,0 +1,153 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/satori/go.uuid"
+)
+
+// Upload is a resumable (tus) upload. Once Completed the data has been moved to
+// the blob storage under the uploads ID and may be attached to a message.
+type Upload struct {
+	ID        string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UserID    uint
+	Length    int64
+	Offset    int64
+	FileName  string
+	MimeType  string
+	SHA256    string
+	Completed bool
+	// Whether the file name is stored encrypted at rest
+	Sealed bool
+}
+
+func scanUpload(u *Upload, row *sql.Row) error {
+	if err := row.Scan(&u.ID, &u.CreatedAt, &u.ExpiresAt, &u.UserID, &u.Length, &u.Offset, &u.FileName, &u.MimeType, &u.SHA256, &u.Completed, &u.Sealed); err != nil {
+		return err
+	}
+
+	return u.openFileName()
+}
+
+// openFileName decrypts the file name of an upload encrypted at rest
+func (u *Upload) openFileName() error {
+	if !u.Sealed {
+		return nil
+	}
+
+	if Sealer == nil {
+		return errors.New("Upload is encrypted but no sealer is set")
+	}
+
+	var err error
+	u.FileName, err = Sealer.Open(u.FileName)
+	return err
+}
+
+func FindUpload(DB *sql.DB, id string) (Upload, error) {
+	row := DB.QueryRow("SELECT * FROM uploads WHERE id=$1", id)
+
+	u := Upload{}
+	err := scanUpload(&u, row)
+
+	return u, err
+}
+
+func FindExpiredUploads(DB *sql.DB) ([]Upload, error) {
+	uploads := []Upload{}
+
+	rows, err := DB.Query("SELECT * FROM uploads WHERE expires_at < current_timestamp")
+	if err != nil {
+		return uploads, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u Upload
+		err := rows.Scan(&u.ID, &u.CreatedAt, &u.ExpiresAt, &u.UserID, &u.Length, &u.Offset, &u.FileName, &u.MimeType, &u.SHA256, &u.Completed, &u.Sealed)
+		if err != nil {
+			return uploads, err
+		}
+		if err := u.openFileName(); err != nil {
+			return uploads, err
+		}
+		uploads = append(uploads, u)
+	}
+
+	return uploads, rows.Err()
+}
+
+// Create stores a new upload. The file name is sealed with the data key of the
+// user if encryption at rest is enabled.
+func (u *Upload) Create(DB *sql.DB) error {
+	u.ID = uuid.NewV4().String()
+	u.Sealed = Sealer != nil && Sealer.Enabled()
+
+	fileName := u.FileName
+	if u.Sealed {
+		var err error
+		if fileName, err = Sealer.Seal(u.UserID, u.FileName); err != nil {
+			return err
+		}
+	}
+
+	return DB.QueryRow("INSERT INTO uploads (id, created_at, expires_at, user_id, length, file_name, sealed) VALUES ($1, current_timestamp, $2, $3, $4, $5, $6) RETURNING created_at, upload_offset, completed", u.ID, u.ExpiresAt, u.UserID, u.Length, fileName, u.Sealed).Scan(&u.CreatedAt, &u.Offset, &u.Completed)
+}
+
+// Update stores the offset, expiry and, once completed, the metadata of the
+// finished file
+func (u *Upload) Update(DB *sql.DB) error {
+	_, err := DB.Exec("UPDATE uploads SET upload_offset=$2, expires_at=$3, mime_type=$4, sha256=$5, completed=$6 WHERE id=$1", u.ID, u.Offset, u.ExpiresAt, u.MimeType, u.SHA256, u.Completed)
+	return err
+}
+
+func (u *Upload) Delete(DB *sql.DB) error {
+	if u.ID == "" {
+		return errors.New("Upload object has no ID")
+	}
+
+	res, err := DB.Exec("DELETE FROM uploads WHERE id=$1", u.ID)
+
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected <= 0 {
+		return errors.New("No such database entry")
+	}
+
+	return nil
+}
+
+// LockUploads locks the completed uploads of the user inside tx so that they
+// can't be attached to two messages at once. If any of them doesn't exist
+// (anymore) sql.ErrNoRows is returned.
+func LockUploads(tx *sql.Tx, userID uint, ids []string) error {
+	var locked int
+	if err := tx.QueryRow("SELECT count(*) FROM (SELECT id FROM uploads WHERE id = ANY($1) AND user_id=$2 AND completed=true FOR UPDATE) AS locked", pq.StringArray(ids), userID).Scan(&locked); err != nil {
+		return err
+	}
+
+	if locked != len(ids) {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// ConsumeUploads deletes uploads locked with LockUploads once their files
+// belong to a message
+func ConsumeUploads(tx *sql.Tx, ids []string) error {
+	_, err := tx.Exec("DELETE FROM uploads WHERE id = ANY($1)", pq.StringArray(ids))
+	return err
+}
@@ -8,21 +8,26 @@ import (
 )
 
 type User struct {
-	ID             uint
-	CreatedAt      time.Time
-	LastModifiedAt time.Time
-	LastSignInAt   time.Time
-	Username       string
-	FirstName      string
-	LastName       string
-	Email          string
-	EmailConfirmed bool
-	Password       string
-	Devices        []Device
-	Tokens         []AccessToken
-	Messages       []Message
-	Friends        []Friendship
-	FriendOf       []Friendship
+	ID              uint
+	CreatedAt       time.Time
+	LastModifiedAt  time.Time
+	LastSignInAt    time.Time
+	Username        string
+	FirstName       string
+	LastName        string
+	Email           string
+	EmailConfirmed  bool
+	Password        string
+	MaxUploadSize   sql.NullInt64
+	PlanID          uint
+	MaxStorageBytes sql.NullInt64
+	MaxFiles        sql.NullInt64
+	StorageUsage    StorageUsage
+	Devices         []Device
+	Tokens          []AccessToken
+	Messages        []Message
+	Friends         []Friendship
+	FriendOf        []Friendship
 }
 
 type Friendship struct {
@@ -35,7 +40,7 @@ type Friendship struct {
 
 func scanUser(row *sql.Row) (User, error) {
 	u := User{}
-	err := row.Scan(&u.ID, &u.CreatedAt, &u.LastModifiedAt, &u.LastSignInAt, &u.Username, &u.FirstName, &u.LastName, &u.Email, &u.EmailConfirmed, &u.Password)
+	err := row.Scan(&u.ID, &u.CreatedAt, &u.LastModifiedAt, &u.LastSignInAt, &u.Username, &u.FirstName, &u.LastName, &u.Email, &u.EmailConfirmed, &u.Password, &u.MaxUploadSize, &u.PlanID, &u.MaxStorageBytes, &u.MaxFiles, &u.StorageUsage.Bytes, &u.StorageUsage.Files)
 
 	return u, err
 }
@@ -91,6 +96,15 @@ func (u *User) ComparePassword(plaintextPassword string) error {
 	return bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(plaintextPassword))
 }
 
+// UploadLimit returns the maximum size of a single upload of the user
+func (u *User) UploadLimit(defaultLimit int64) int64 {
+	if u.MaxUploadSize.Valid {
+		return u.MaxUploadSize.Int64
+	}
+
+	return defaultLimit
+}
+
 func (u *User) LoadDevices(DB *sql.DB) error {
 	var err error
 	u.Devices, err = FindDevicesByUserID(DB, u.ID)
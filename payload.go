@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/irrenhaus/pushmearound_server/events"
+	"github.com/irrenhaus/pushmearound_server/httpresponse"
+	"github.com/irrenhaus/pushmearound_server/models"
+)
+
+// PayloadSchemaHandler serves the JSON schema of the payload of a content
+// type, e.g. /schemas/checklist
+func PayloadSchemaHandler(resp http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	for contentType, name := range models.ContentTypeNames {
+		if name != vars["type"] {
+			continue
+		}
+
+		schema, ok := models.PayloadSchemas[contentType]
+		if !ok {
+			break
+		}
+
+		resp.Header().Set("Content-Type", "application/schema+json")
+		resp.Write([]byte(schema))
+		return
+	}
+
+	httpresponse.NotFound("No such schema").WriteJSON(resp)
+}
+
+// ChecklistItemHandler checks or unchecks an item of a checklist. All other
+// devices of the user are notified of the change.
+func ChecklistItemHandler(resp http.ResponseWriter, req *http.Request) {
+	user, ok := context.Get(req, ContextKeyUser).(models.User)
+	if !ok {
+		httpresponse.InternalServerError("Could not convert user").WriteJSON(resp)
+		return
+	}
+
+	vars := mux.Vars(req)
+	msgID, err := strconv.ParseUint(vars["msg"], 10, 32)
+	if err != nil {
+		httpresponse.BadRequest("Invalid message ID").WriteJSON(resp)
+		return
+	}
+
+	item, err := strconv.Atoi(vars["item"])
+	if err != nil {
+		httpresponse.BadRequest("Invalid item").WriteJSON(resp)
+		return
+	}
+
+	checked, err := strconv.ParseBool(req.FormValue("checked"))
+	if err != nil {
+		httpresponse.BadRequest("checked has to be a boolean").WriteJSON(resp)
+		return
+	}
+
+	msg, err := models.UpdateChecklistItem(DB, user.ID, uint(msgID), item, checked)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			httpresponse.NotFound("No such checklist").WriteJSON(resp)
+		case models.ErrNoSuchChecklistItem:
+			httpresponse.NotFound(err.Error()).WriteJSON(resp)
+		default:
+			log.WithFields(log.Fields{"user": user.ID, "msg": msgID, "error": err}).Error("SQL error while updating checklist")
+			httpresponse.InternalServerError("Updating the checklist failed").WriteJSON(resp)
+		}
+		return
+	}
+
+	Events.Publish(user.ID, events.Event{
+		Type:           events.TypeChecklistUpdated,
+		OriginDeviceID: req.FormValue("device"),
+		Data: map[string]interface{}{
+			"message_id": msg.ID,
+			"item":       item,
+			"checked":    checked,
+		},
+	})
+
+	response := httpresponse.Success("")
+	response.Data = msg.Payload
+	response.WriteJSON(resp)
+}
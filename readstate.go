@@ -0,0 +1,222 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/irrenhaus/pushmearound_server/events"
+	"github.com/irrenhaus/pushmearound_server/httpresponse"
+	"github.com/irrenhaus/pushmearound_server/models"
+)
+
+// publishReadState tells the users other devices which messages changed their
+// read state on the given device
+func publishReadState(user models.User, deviceID string, messageIDs []uint, unread bool) {
+	if len(messageIDs) == 0 {
+		return
+	}
+
+	Events.Publish(user.ID, events.Event{
+		Type:           events.TypeReadStateChanged,
+		OriginDeviceID: deviceID,
+		Data: map[string]interface{}{
+			"device_id":   deviceID,
+			"message_ids": messageIDs,
+			"unread":      unread,
+		},
+	})
+}
+
+// updateReadState runs the update and writes the response. The device of the
+// update, if any, has to belong to the user.
+func updateReadState(resp http.ResponseWriter, user models.User, update models.ReadStateUpdate) {
+	if update.DeviceID != "" {
+		device, err := models.FindDevice(DB, update.DeviceID)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				log.WithFields(log.Fields{"user": user.ID, "device": update.DeviceID, "error": err}).Error("SQL error while finding device")
+			}
+
+			httpresponse.NotFound("No such device").WriteJSON(resp)
+			return
+		}
+
+		if device.UserID != user.ID {
+			httpresponse.NotFound("No such device").WriteJSON(resp)
+			return
+		}
+	}
+
+	update.UserID = user.ID
+
+	changed, err := models.UpdateReadState(DB, update)
+	if err != nil {
+		if err == models.ErrUnknownMessages {
+			httpresponse.NotFound(err.Error()).WriteJSON(resp)
+			return
+		}
+
+		log.WithFields(log.Fields{"user": user.ID, "device": update.DeviceID, "error": err}).Error("SQL error while updating read state")
+		httpresponse.InternalServerError("Updating the read state failed").WriteJSON(resp)
+		return
+	}
+
+	publishReadState(user, update.DeviceID, changed, update.Unread)
+
+	response := httpresponse.Success("")
+	response.Data = map[string][]uint{
+		"message_ids": changed,
+	}
+	response.WriteJSON(resp)
+}
+
+func MarkAllReadHandler(resp http.ResponseWriter, req *http.Request) {
+	user, ok := context.Get(req, ContextKeyUser).(models.User)
+	if !ok {
+		httpresponse.InternalServerError("Could not convert user").WriteJSON(resp)
+		return
+	}
+
+	deviceID := req.FormValue("device")
+	if deviceID == "" {
+		httpresponse.BadRequest("No device specified").WriteJSON(resp)
+		return
+	}
+
+	updateReadState(resp, user, models.ReadStateUpdate{
+		DeviceID: deviceID,
+		Unread:   false,
+	})
+}
+
+func MarkReadUpToHandler(resp http.ResponseWriter, req *http.Request) {
+	user, ok := context.Get(req, ContextKeyUser).(models.User)
+	if !ok {
+		httpresponse.InternalServerError("Could not convert user").WriteJSON(resp)
+		return
+	}
+
+	vars := mux.Vars(req)
+	msgID, err := strconv.ParseUint(vars["msg"], 10, 32)
+	if err != nil || msgID == 0 {
+		httpresponse.BadRequest("Invalid message ID").WriteJSON(resp)
+		return
+	}
+
+	updateReadState(resp, user, models.ReadStateUpdate{
+		DeviceID:      req.FormValue("device"),
+		UpToMessageID: uint(msgID),
+		Unread:        false,
+	})
+}
+
+// MarkReadListHandler sets the read state of a comma separated list of
+// message IDs. Pass unread=true to mark them as unread again.
+func MarkReadListHandler(resp http.ResponseWriter, req *http.Request) {
+	user, ok := context.Get(req, ContextKeyUser).(models.User)
+	if !ok {
+		httpresponse.InternalServerError("Could not convert user").WriteJSON(resp)
+		return
+	}
+
+	messageIDs := []uint{}
+	for _, field := range strings.Split(req.FormValue("ids"), ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		id, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			httpresponse.BadRequest("ids has to be a comma separated list of message IDs").WriteJSON(resp)
+			return
+		}
+
+		messageIDs = append(messageIDs, uint(id))
+	}
+
+	if len(messageIDs) == 0 {
+		httpresponse.BadRequest("No message IDs specified").WriteJSON(resp)
+		return
+	}
+
+	unread := false
+	if value := req.FormValue("unread"); value != "" {
+		var err error
+		if unread, err = strconv.ParseBool(value); err != nil {
+			httpresponse.BadRequest("unread has to be a boolean").WriteJSON(resp)
+			return
+		}
+	}
+
+	updateReadState(resp, user, models.ReadStateUpdate{
+		DeviceID:   req.FormValue("device"),
+		MessageIDs: messageIDs,
+		Unread:     unread,
+	})
+}
+
+// DismissMessageHandler is called by a device once the user dismissed the
+// notification of a message. All other devices are told to clear theirs.
+func DismissMessageHandler(resp http.ResponseWriter, req *http.Request) {
+	user, ok := context.Get(req, ContextKeyUser).(models.User)
+	if !ok {
+		httpresponse.InternalServerError("Could not convert user").WriteJSON(resp)
+		return
+	}
+
+	vars := mux.Vars(req)
+	msgID, err := strconv.ParseUint(vars["msg"], 10, 32)
+	if err != nil {
+		httpresponse.BadRequest("Invalid message ID").WriteJSON(resp)
+		return
+	}
+
+	deviceID := req.FormValue("device")
+	if deviceID == "" {
+		httpresponse.BadRequest("No device specified").WriteJSON(resp)
+		return
+	}
+
+	device, err := models.FindDevice(DB, deviceID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.WithFields(log.Fields{"user": user.ID, "device": deviceID, "error": err}).Error("SQL error while finding device")
+		}
+
+		httpresponse.NotFound("No such device").WriteJSON(resp)
+		return
+	}
+
+	if device.UserID != user.ID {
+		httpresponse.NotFound("No such device").WriteJSON(resp)
+		return
+	}
+
+	if err := models.DismissReceivedMessages(DB, user.ID, uint(msgID)); err != nil {
+		if err != sql.ErrNoRows {
+			log.WithFields(log.Fields{"user": user.ID, "msg": msgID, "error": err}).Error("SQL error while dismissing message")
+			httpresponse.InternalServerError("Dismissing the message failed").WriteJSON(resp)
+			return
+		}
+
+		httpresponse.NotFound("No such message").WriteJSON(resp)
+		return
+	}
+
+	Events.Publish(user.ID, events.Event{
+		Type:           events.TypeMessageDismissed,
+		OriginDeviceID: device.ID,
+		Data: map[string]interface{}{
+			"device_id":  device.ID,
+			"message_id": uint(msgID),
+		},
+	})
+
+	httpresponse.Success("").WriteJSON(resp)
+}
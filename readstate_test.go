@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/irrenhaus/pushmearound_server/models"
+)
+
+func TestUpdateMessageReadState(t *testing.T) {
+	setupTestDatabase(t)
+
+	user, devices := createTestUser(t, "reader", 3)
+	other, otherDevices := createTestUser(t, "other", 1)
+
+	msg := models.Message{
+		UserID:      user.ID,
+		DeviceID:    devices[0].ID,
+		ContentType: models.ContentTypeURL,
+		URL:         "https://example.com/",
+	}
+	if err := msg.Create(DB); err != nil {
+		t.Fatal(err)
+	}
+	for _, device := range devices {
+		if sendMessageToDevice(msg, device.ID, "") == nil {
+			t.Fatal("Could not deliver the message")
+		}
+	}
+
+	unread := func(device models.Device) bool {
+		received, err := models.FindReceivedMessageByMessageAndDevice(DB, msg.ID, device.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return received.Unread
+	}
+
+	update := func(user models.User, query string) int {
+		req := httptest.NewRequest("PUT", fmt.Sprintf("/msg/%d?%s", msg.ID, query), nil)
+		return serveAs(user, UpdateMessageHandler, "PUT", "/msg/{msg:[0-9]+}", req).Code
+	}
+
+	// A single device
+	if code := update(user, "unread=false&device="+devices[1].ID); code != 200 {
+		t.Fatalf("Update for a device returned %d", code)
+	}
+	if !unread(devices[0]) || unread(devices[1]) || !unread(devices[2]) {
+		t.Error("Updating the copy of one device changed the others")
+	}
+
+	// All devices of the user
+	if code := update(user, "unread=false"); code != 200 {
+		t.Fatalf("Update for all devices returned %d", code)
+	}
+	for _, device := range devices {
+		if unread(device) {
+			t.Errorf("The copy of %s is still unread", device.Name)
+		}
+	}
+
+	// Other users can't touch the message
+	if code := update(other, "unread=true"); code != 404 {
+		t.Errorf("Update by another user returned %d, want 404", code)
+	}
+	if code := update(other, "unread=true&device="+otherDevices[0].ID); code != 404 {
+		t.Errorf("Update by another users device returned %d, want 404", code)
+	}
+	for _, device := range devices {
+		if unread(device) {
+			t.Errorf("Another user marked the copy of %s unread", device.Name)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/irrenhaus/pushmearound_server/httpresponse"
+	"github.com/irrenhaus/pushmearound_server/models"
+)
+
+// scanUpload passes a freshly stored file through the configured scanner and
+// records the verdict on the attachment. Without a scanner nothing happens.
+func scanUpload(attachment *models.Attachment) error {
+	if UploadScanner == nil {
+		return nil
+	}
+
+	blob, err := openBlob(attachment.File)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	verdict, err := UploadScanner.Scan(blob)
+	if err != nil {
+		return err
+	}
+
+	attachment.ScanStatus = models.ScanStatusClean
+	if verdict.Infected {
+		attachment.ScanStatus = models.ScanStatusInfected
+		attachment.ScanSignature = verdict.Signature
+	}
+
+	return nil
+}
+
+// Infected files are moved to keys with this prefix. The janitor leaves them
+// alone and they are never registered as blobs, so no other attachment can
+// end up sharing them.
+const quarantinePrefix = "quarantine-"
+
+func isQuarantined(key string) bool {
+	return strings.HasPrefix(key, quarantinePrefix)
+}
+
+// quarantineAttachment copies the file of an infected attachment to the
+// quarantine and switches the attachment over to the copy. The file is copied
+// as stored, encrypted files stay encrypted. The caller deletes the original
+// once it isn't needed anymore.
+func quarantineAttachment(attachment *models.Attachment) error {
+	src, err := BlobStorage.Get(attachment.File)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	key := quarantinePrefix + attachment.File
+	if _, err := BlobStorage.Put(key, src); err != nil {
+		deleteUpload(key)
+		return err
+	}
+
+	attachment.File = key
+	return nil
+}
+
+// writeDeliveryRefused tells the sender that the message was kept from the
+// devices because of infected attachments
+func writeDeliveryRefused(resp http.ResponseWriter, msg models.Message) {
+	infected := []map[string]string{}
+	for _, attachment := range msg.Attachments {
+		if attachment.Infected() {
+			log.WithFields(log.Fields{"user": msg.UserID, "msg": msg.ID, "file": attachment.File, "signature": attachment.ScanSignature}).Warn("Quarantined infected upload")
+
+			infected = append(infected, map[string]string{
+				"file_name": attachment.FileName,
+				"signature": attachment.ScanSignature,
+			})
+		}
+	}
+
+	response := httpresponse.Error(http.StatusUnprocessableEntity, "Infected files were not delivered")
+	response.Data = map[string]interface{}{
+		"message_id": msg.ID,
+		"infected":   infected,
+	}
+	response.WriteJSON(resp)
+}
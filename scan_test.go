@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/irrenhaus/pushmearound_server/models"
+	"github.com/irrenhaus/pushmearound_server/scanner"
+)
+
+// testScanner finds files containing the word "virus"
+type testScanner struct{}
+
+func (testScanner) Scan(r io.Reader) (scanner.Verdict, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return scanner.Verdict{}, err
+	}
+
+	if strings.Contains(string(data), "virus") {
+		return scanner.Verdict{Infected: true, Signature: "Test.Virus"}, nil
+	}
+
+	return scanner.Verdict{}, nil
+}
+
+type testDeliveryRefused struct {
+	MessageID uint `json:"message_id"`
+	Infected  []map[string]string
+}
+
+func TestSendInfectedFile(t *testing.T) {
+	setupTestDatabase(t)
+	UploadScanner = testScanner{}
+
+	user, devices := createTestUser(t, "sender", 2)
+
+	req := newSendRequest(t, map[string]string{
+		"device_id":    devices[0].ID,
+		"content_type": fmt.Sprint(models.ContentTypeFile),
+	}, testFile{"clean.txt", "harmless"}, testFile{"bad.exe", "a virus"})
+
+	refused := testDeliveryRefused{}
+	decodeResponse(t, serveAs(user, SendMessageHandler, "POST", "/msg/send", req), 422, &refused)
+
+	if len(refused.Infected) != 1 || refused.Infected[0]["file_name"] != "bad.exe" || refused.Infected[0]["signature"] != "Test.Virus" {
+		t.Errorf("Reported infected files %v", refused.Infected)
+	}
+
+	// The verdict is recorded on the stored message
+	attachments, err := models.FindAttachmentsByMessages(DB, []uint{refused.MessageID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attachments) != 2 {
+		t.Fatalf("Stored attachments %+v", attachments)
+	}
+
+	if attachments[0].Infected() || attachments[0].ScanStatus != models.ScanStatusClean {
+		t.Errorf("The clean file was recorded as %+v", attachments[0])
+	}
+	if !attachments[1].Infected() || attachments[1].ScanSignature != "Test.Virus" || !isQuarantined(attachments[1].File) {
+		t.Errorf("The infected file was recorded as %+v", attachments[1])
+	}
+
+	// Only the quarantined copy of the infected file is left
+	keys := map[string]bool{}
+	for _, key := range storedBlobs(t) {
+		keys[key] = true
+	}
+	if len(keys) != 2 || !keys[attachments[0].File] || !keys[attachments[1].File] {
+		t.Errorf("Stored files %v", keys)
+	}
+
+	for _, device := range devices {
+		if _, err := models.FindReceivedMessageByMessageAndDevice(DB, refused.MessageID, device.ID); err == nil {
+			t.Errorf("%s received the message", device.Name)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package scanner
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Size of the chunks the file is streamed to clamd in. clamd refuses chunks
+// larger than its StreamMaxLength.
+const clamdChunkSize = 64 * 1024
+
+// Clamd scans files by streaming them to a clamd daemon using the INSTREAM
+// command
+type Clamd struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// NewClamd creates a scanner talking to clamd at address, either host:port or
+// unix:/path/to/clamd.sock. The timeout applies to a whole scan.
+func NewClamd(address string, timeout time.Duration) (*Clamd, error) {
+	if address == "" {
+		return nil, errors.New("No clamd address configured")
+	}
+
+	c := &Clamd{
+		network: "tcp",
+		address: address,
+		timeout: timeout,
+	}
+
+	if strings.HasPrefix(address, "unix:") {
+		c.network = "unix"
+		c.address = strings.TrimPrefix(address, "unix:")
+	}
+
+	return c, nil
+}
+
+func (c *Clamd) Scan(r io.Reader) (Verdict, error) {
+	conn, err := net.DialTimeout(c.network, c.address, c.timeout)
+	if err != nil {
+		return Verdict{}, err
+	}
+	defer conn.Close()
+
+	if c.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+
+	// The z prefix makes clamd use NUL terminated commands and replies
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return Verdict{}, err
+	}
+
+	// Every chunk is prefixed with its length, a zero length ends the stream
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return Verdict{}, err
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return Verdict{}, err
+		}
+	}
+
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return Verdict{}, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return Verdict{}, err
+	}
+
+	return parseClamdReply(strings.TrimRight(reply, "\x00"))
+}
+
+// parseClamdReply interprets replies like "stream: OK" or
+// "stream: Eicar-Test-Signature FOUND"
+func parseClamdReply(reply string) (Verdict, error) {
+	result := strings.TrimSpace(reply)
+	if i := strings.Index(result, ": "); i >= 0 {
+		result = result[i+2:]
+	}
+
+	switch {
+	case result == "OK":
+		return Verdict{}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return Verdict{
+			Infected:  true,
+			Signature: strings.TrimSuffix(result, " FOUND"),
+		}, nil
+	}
+
+	return Verdict{}, fmt.Errorf("clamd: %s", result)
+}
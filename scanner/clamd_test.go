@@ -0,0 +1,266 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClamd speaks just enough of the clamd protocol to answer INSTREAM
+// commands. reply decides the answer from the streamed data.
+type fakeClamd struct {
+	t         *testing.T
+	listener  net.Listener
+	maxLength int
+	reply     func(data []byte) string
+	received  chan []byte
+}
+
+func newFakeClamd(t *testing.T, reply func(data []byte) string) *fakeClamd {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeClamd{
+		t:         t,
+		listener:  listener,
+		maxLength: 1 << 20,
+		reply:     reply,
+		received:  make(chan []byte, 1),
+	}
+	go f.serve()
+	t.Cleanup(func() { listener.Close() })
+
+	return f
+}
+
+func (f *fakeClamd) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeClamd) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	command, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+	if command != "zINSTREAM\x00" {
+		io.WriteString(conn, "UNKNOWN COMMAND\x00")
+		return
+	}
+
+	data := []byte{}
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return
+		}
+
+		size := binary.BigEndian.Uint32(header)
+		if size == 0 {
+			break
+		}
+		if size > clamdChunkSize {
+			f.t.Errorf("Got a chunk of %d bytes, larger than %d", size, clamdChunkSize)
+		}
+
+		// Like clamd, give up as soon as the stream gets too long
+		if len(data)+int(size) > f.maxLength {
+			io.WriteString(conn, "INSTREAM size limit exceeded. ERROR\x00")
+			return
+		}
+
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return
+		}
+		data = append(data, chunk...)
+	}
+
+	select {
+	case f.received <- data:
+	default:
+	}
+
+	io.WriteString(conn, f.reply(data)+"\x00")
+}
+
+func (f *fakeClamd) scanner(t *testing.T) *Clamd {
+	c, err := NewClamd(f.listener.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+func fakeSignatures(data []byte) string {
+	if bytes.Contains(data, []byte("EICAR-STANDARD-ANTIVIRUS-TEST-FILE")) {
+		return "stream: Eicar-Test-Signature FOUND"
+	}
+
+	return "stream: OK"
+}
+
+func TestClamdClean(t *testing.T) {
+	f := newFakeClamd(t, fakeSignatures)
+
+	// Large enough to be sent in several chunks
+	data := bytes.Repeat([]byte("harmless "), 30000)
+
+	verdict, err := f.scanner(t).Scan(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if verdict.Infected || verdict.Signature != "" {
+		t.Errorf("Scan returned %+v for a clean file", verdict)
+	}
+
+	if received := <-f.received; !bytes.Equal(received, data) {
+		t.Errorf("clamd received %d bytes, want the %d bytes of the file", len(received), len(data))
+	}
+}
+
+func TestClamdEmpty(t *testing.T) {
+	f := newFakeClamd(t, fakeSignatures)
+
+	verdict, err := f.scanner(t).Scan(strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if verdict.Infected {
+		t.Errorf("Scan returned %+v for an empty file", verdict)
+	}
+}
+
+func TestClamdFound(t *testing.T) {
+	f := newFakeClamd(t, fakeSignatures)
+
+	verdict, err := f.scanner(t).Scan(strings.NewReader(eicar))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !verdict.Infected || verdict.Signature != "Eicar-Test-Signature" {
+		t.Errorf("Scan returned %+v, want an infection with Eicar-Test-Signature", verdict)
+	}
+}
+
+func TestClamdErrorReply(t *testing.T) {
+	f := newFakeClamd(t, func(data []byte) string {
+		return "stream: Can't allocate memory ERROR"
+	})
+
+	verdict, err := f.scanner(t).Scan(strings.NewReader("data"))
+	if err == nil {
+		t.Fatalf("Scan returned %+v for an error reply", verdict)
+	}
+
+	if !strings.Contains(err.Error(), "Can't allocate memory") {
+		t.Errorf("Scan returned %q, want the clamd error", err)
+	}
+	if verdict.Infected {
+		t.Error("An error reply was taken as an infection")
+	}
+}
+
+func TestClamdSizeLimit(t *testing.T) {
+	f := newFakeClamd(t, fakeSignatures)
+	f.maxLength = 2 * clamdChunkSize
+
+	// clamd either answers with an error or hangs up while the file is still
+	// being sent, both have to fail the scan
+	verdict, err := f.scanner(t).Scan(bytes.NewReader(make([]byte, 10*clamdChunkSize)))
+	if err == nil {
+		t.Fatalf("Scan returned %+v for a file over the size limit", verdict)
+	}
+	if verdict.Infected {
+		t.Error("A size limit error was taken as an infection")
+	}
+}
+
+func TestClamdUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	c, err := NewClamd(address, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Scan(strings.NewReader("data")); err == nil {
+		t.Error("Scan succeeded without clamd")
+	}
+}
+
+func TestNewClamd(t *testing.T) {
+	if _, err := NewClamd("", time.Second); err == nil {
+		t.Error("NewClamd accepted an empty address")
+	}
+
+	c, err := NewClamd("unix:/run/clamav/clamd.ctl", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.network != "unix" || c.address != "/run/clamav/clamd.ctl" {
+		t.Errorf("NewClamd parsed the socket as %s %s", c.network, c.address)
+	}
+
+	c, err = NewClamd("localhost:3310", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.network != "tcp" || c.address != "localhost:3310" {
+		t.Errorf("NewClamd parsed the address as %s %s", c.network, c.address)
+	}
+}
+
+func TestParseClamdReply(t *testing.T) {
+	tests := []struct {
+		reply     string
+		infected  bool
+		signature string
+		err       bool
+	}{
+		{"stream: OK", false, "", false},
+		{"stream: OK\n", false, "", false},
+		{"stream: Win.Test.EICAR_HDB-1 FOUND", true, "Win.Test.EICAR_HDB-1", false},
+		{"stream: Size limit reached ERROR", false, "", true},
+		{"INSTREAM size limit exceeded. ERROR", false, "", true},
+		{"", false, "", true},
+	}
+
+	for _, test := range tests {
+		verdict, err := parseClamdReply(test.reply)
+		if (err != nil) != test.err {
+			t.Errorf("parseClamdReply(%q) returned error %v", test.reply, err)
+			continue
+		}
+
+		if verdict.Infected != test.infected || verdict.Signature != test.signature {
+			t.Errorf("parseClamdReply(%q) = %+v", test.reply, verdict)
+		}
+	}
+}
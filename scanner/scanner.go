@@ -0,0 +1,17 @@
+package scanner
+
+import (
+	"io"
+)
+
+// Verdict is the result of scanning a file. Signature names the detected
+// malware, if any.
+type Verdict struct {
+	Infected  bool
+	Signature string
+}
+
+// Scanner checks uploaded files for malware
+type Scanner interface {
+	Scan(r io.Reader) (Verdict, error)
+}
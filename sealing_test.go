@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/irrenhaus/pushmearound_server/encryption"
+	"github.com/irrenhaus/pushmearound_server/models"
+)
+
+// enableTestEncryption turns on encryption at rest with a fixed master key
+func enableTestEncryption(t *testing.T) {
+	master, err := encryption.NewMaster(bytes.Repeat([]byte{7}, encryption.KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setTestMasterKey(t, master)
+}
+
+func TestSealedLongTitle(t *testing.T) {
+	setupTestDatabase(t)
+	enableTestEncryption(t)
+
+	user, devices := createTestUser(t, "sealer", 1)
+
+	title := strings.Repeat("t", 255)
+	msg := models.Message{
+		UserID:      user.ID,
+		DeviceID:    devices[0].ID,
+		ContentType: models.ContentTypeURL,
+		Title:       title,
+		URL:         "https://example.com/",
+	}
+	if err := msg.Create(DB); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := models.FindMessage(DB, msg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.Sealed || stored.Title != title {
+		t.Errorf("Stored title %q, sealed %v", stored.Title, stored.Sealed)
+	}
+}
+
+func TestSealedFileNames(t *testing.T) {
+	setupTestDatabase(t)
+	enableTestEncryption(t)
+
+	user, devices := createTestUser(t, "sealer", 1)
+
+	req := newSendRequest(t, map[string]string{
+		"device_id":    devices[0].ID,
+		"content_type": fmt.Sprint(models.ContentTypeFile),
+		"actions":      `[{"id": "ok", "label": "OK"}]`,
+		"callback_url": "https://example.com/merger-hook",
+	}, testFile{"merger-plans.pdf", "content"})
+
+	sent := testMessageSent{}
+	decodeResponse(t, serveAs(user, SendMessageHandler, "POST", "/msg/send", req), 200, &sent)
+
+	// Nothing in the rows gives the names away
+	var messageFileName, callbackURL, attachmentFileName string
+	if err := DB.QueryRow("SELECT file_name, callback_url FROM messages WHERE id=$1", sent.MessageID).Scan(&messageFileName, &callbackURL); err != nil {
+		t.Fatal(err)
+	}
+	if err := DB.QueryRow("SELECT file_name FROM attachments WHERE message_id=$1", sent.MessageID).Scan(&attachmentFileName); err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{messageFileName, callbackURL, attachmentFileName} {
+		if strings.Contains(value, "merger") {
+			t.Errorf("Stored in plaintext: %q", value)
+		}
+	}
+
+	var indexed bool
+	if err := DB.QueryRow("SELECT search_vector @@ plainto_tsquery('simple', 'merger') FROM messages WHERE id=$1", sent.MessageID).Scan(&indexed); err != nil {
+		t.Fatal(err)
+	}
+	if indexed {
+		t.Error("The file name is in the search index")
+	}
+
+	msg, err := models.FindMessage(DB, sent.MessageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.FileName != "merger-plans.pdf" || msg.CallbackURL != "https://example.com/merger-hook" {
+		t.Errorf("Loaded file name %q and callback URL %q", msg.FileName, msg.CallbackURL)
+	}
+
+	attachments, err := models.FindAttachmentsByMessages(DB, []uint{sent.MessageID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attachments) != 1 || attachments[0].FileName != "merger-plans.pdf" {
+		t.Errorf("Loaded attachments %+v", attachments)
+	}
+}
+
+func TestSealedUploadFileName(t *testing.T) {
+	setupTestDatabase(t)
+	enableTestEncryption(t)
+
+	user, _ := createTestUser(t, "uploader", 1)
+
+	upload := models.Upload{
+		UserID:    user.ID,
+		Length:    10,
+		FileName:  "merger-plans.pdf",
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+	if err := upload.Create(DB); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored string
+	if err := DB.QueryRow("SELECT file_name FROM uploads WHERE id=$1", upload.ID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stored, "merger") {
+		t.Errorf("Stored in plaintext: %q", stored)
+	}
+
+	loaded, err := models.FindUpload(DB, upload.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.FileName != "merger-plans.pdf" {
+		t.Errorf("Loaded file name %q", loaded.FileName)
+	}
+}
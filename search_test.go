@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/irrenhaus/pushmearound_server/models"
+)
+
+type testSearchPage struct {
+	Messages []struct {
+		Message struct {
+			ID uint
+		}
+		Rank float64
+	} `json:"messages"`
+	NextCursor string `json:"next_cursor"`
+}
+
+func TestSearchPagination(t *testing.T) {
+	setupTestDatabase(t)
+
+	user, devices := createTestUser(t, "searcher", 1)
+
+	// Several messages with the same rank, so that pages have to break ties
+	// by ID, and a few ranked higher
+	titles := []string{
+		"holiday photos",
+		"holiday photos",
+		"holiday photos",
+		"holiday holiday photos",
+		"holiday photos",
+		"holiday holiday holiday",
+		"holiday photos",
+		"unrelated",
+	}
+
+	for _, title := range titles {
+		msg := models.Message{
+			UserID:      user.ID,
+			DeviceID:    devices[0].ID,
+			ContentType: models.ContentTypeURL,
+			Title:       title,
+			URL:         "https://example.com/",
+		}
+		if err := msg.Create(DB); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, limit := range []string{"1", "2", "3"} {
+		seen := map[uint]bool{}
+		var lastRank float64
+		var lastID uint
+		cursor := ""
+
+		for page := 0; ; page++ {
+			if page > len(titles) {
+				t.Fatalf("limit %s: pagination doesn't end", limit)
+			}
+
+			query := url.Values{"q": {"holiday"}, "limit": {limit}}
+			if cursor != "" {
+				query.Set("before", cursor)
+			}
+
+			req := httptest.NewRequest("GET", "/msg/search?"+query.Encode(), nil)
+			resp := serveAs(user, SearchMessageHandler, "GET", "/msg/search", req)
+
+			result := testSearchPage{}
+			decodeResponse(t, resp, 200, &result)
+
+			for _, entry := range result.Messages {
+				id := entry.Message.ID
+				if seen[id] {
+					t.Fatalf("limit %s: message %d returned twice", limit, id)
+				}
+				seen[id] = true
+
+				if len(seen) > 1 && (entry.Rank > lastRank || (entry.Rank == lastRank && id > lastID)) {
+					t.Errorf("limit %s: message %d (rank %g) is out of order after %d (rank %g)", limit, id, entry.Rank, lastID, lastRank)
+				}
+				lastRank, lastID = entry.Rank, id
+			}
+
+			if result.NextCursor == "" {
+				break
+			}
+			if !strings.Contains(result.NextCursor, ":") {
+				t.Fatalf("limit %s: invalid cursor %q", limit, result.NextCursor)
+			}
+			cursor = result.NextCursor
+		}
+
+		if len(seen) != len(titles)-1 {
+			t.Errorf("limit %s: found %d messages, want %d", limit, len(seen), len(titles)-1)
+		}
+	}
+}
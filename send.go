@@ -0,0 +1,677 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/context"
+	"github.com/irrenhaus/pushmearound_server/httpresponse"
+	"github.com/irrenhaus/pushmearound_server/models"
+	"github.com/satori/go.uuid"
+)
+
+// messageSend is the state of a single send request. The steps of sending
+// record everything they store or claim, so that cleanUp can undo all of it
+// if a later step fails.
+type messageSend struct {
+	user        models.User
+	limits      models.StorageLimits
+	uploadLimit int64
+	// The storage usage including the attachments collected so far
+	usage models.StorageUsage
+
+	fields      map[string]string
+	msg         models.Message
+	msgBuilt    bool
+	destination string
+	wrappedKeys map[string]string
+
+	attachments []models.Attachment
+	// Files written by this request. Until they are claimed nothing else
+	// refers to them.
+	stored map[string]bool
+	// Files of tus uploads. They belong to their upload until it is consumed
+	// together with storing the message.
+	uploadIDs []string
+	uploaded  map[string]bool
+	// Copies which turned out to be redundant after deduplication or
+	// quarantine. They are deleted once the message is stored.
+	redundant []string
+	infected  bool
+
+	// Locks the uploads until they are consumed
+	tx       *sql.Tx
+	consumed bool
+	// The attachments before this index have claimed their file
+	claimed   int
+	created   bool
+	delivered []*models.ReceivedMessage
+	done      bool
+}
+
+// sendFailure is what the steps of sending return when they fail: the
+// response to write. Steps which succeed return nil.
+func sendFailure(response httpresponse.HttpResponse) *httpresponse.HttpResponse {
+	return &response
+}
+
+// SendMessageHandler streams the multipart request part by part. All form
+// fields have to come before the files ("sendfile", may be repeated) so that
+// the message can be validated before the uploads are accepted. The files are
+// written to the blob storage as they arrive.
+//
+// More files can be attached by passing comma separated lists of finished tus
+// uploads (upload_id) and hashes of files sent before (sha256). They follow
+// the uploaded files in that order.
+func SendMessageHandler(resp http.ResponseWriter, req *http.Request) {
+	user, ok := context.Get(req, ContextKeyUser).(models.User)
+	if !ok {
+		httpresponse.InternalServerError("Could not convert user").WriteJSON(resp)
+		return
+	}
+
+	s, failure := newMessageSend(user, req)
+	if failure != nil {
+		failure.WriteJSON(resp)
+		return
+	}
+	defer s.cleanUp()
+
+	if failure := s.run(req); failure != nil {
+		failure.WriteJSON(resp)
+		return
+	}
+	s.done = true
+
+	// The message is kept to record the verdict but never reaches any device
+	if s.infected {
+		updateStorageUsage(s.msg.UserID)
+		writeDeliveryRefused(resp, s.msg)
+		return
+	}
+
+	writeMessageSent(resp, s.msg)
+}
+
+// newMessageSend refuses requests which are too large before reading them
+func newMessageSend(user models.User, req *http.Request) (*messageSend, *httpresponse.HttpResponse) {
+	s := &messageSend{
+		user:        user,
+		uploadLimit: user.UploadLimit(*maxUploadSize),
+		usage:       user.StorageUsage,
+		fields:      map[string]string{},
+		wrappedKeys: map[string]string{},
+		attachments: []models.Attachment{},
+		stored:      map[string]bool{},
+		uploaded:    map[string]bool{},
+	}
+
+	if req.ContentLength > s.uploadLimit*maxAttachments+maxMessageOverhead {
+		return nil, sendFailure(httpresponse.Error(http.StatusRequestEntityTooLarge, "Upload too large"))
+	}
+
+	var err error
+	if s.limits, err = user.StorageLimits(DB); err != nil {
+		log.WithFields(log.Fields{"user": user.ID, "error": err}).Error("SQL error while loading storage limits")
+		return nil, sendFailure(httpresponse.InternalServerError("Could not load storage limits"))
+	}
+
+	remainingQuota, quotaLimited := s.limits.RemainingBytes(user.StorageUsage)
+	if quotaLimited && req.ContentLength > remainingQuota+maxMessageOverhead {
+		return nil, sendFailure(quotaExceeded())
+	}
+
+	return s, nil
+}
+
+// run goes through the steps of sending the message, up to the delivery to
+// the devices
+func (s *messageSend) run(req *http.Request) *httpresponse.HttpResponse {
+	reader, err := req.MultipartReader()
+	if err != nil {
+		return sendFailure(httpresponse.BadRequest("Messages have to be sent as multipart/form-data"))
+	}
+
+	steps := []func() *httpresponse.HttpResponse{
+		func() *httpresponse.HttpResponse { return s.readForm(reader) },
+		s.checkRecipients,
+		s.collectUploads,
+		s.collectReferences,
+		s.checkAttachments,
+		s.scan,
+		s.lockUploads,
+		s.claim,
+		s.store,
+		s.deliver,
+	}
+
+	for _, step := range steps {
+		if failure := step(); failure != nil {
+			return failure
+		}
+	}
+
+	return nil
+}
+
+// cleanUp undoes whatever the steps did unless sending succeeded. Files of
+// tus uploads are left alone until the uploads are consumed, they still
+// belong to the upload.
+func (s *messageSend) cleanUp() {
+	if s.done {
+		return
+	}
+
+	if s.tx != nil {
+		s.tx.Rollback()
+	}
+
+	for _, delivered := range s.delivered {
+		delivered.Delete(DB)
+	}
+
+	if s.created {
+		s.msg.Delete(DB)
+	}
+
+	uploaded := s.uploaded
+	if s.consumed {
+		uploaded = nil
+	}
+	abandonAttachments(s.attachments[:s.claimed], uploaded)
+
+	for _, attachment := range s.attachments[s.claimed:] {
+		if s.stored[attachment.File] {
+			deleteUpload(attachment.File)
+		}
+	}
+}
+
+// abandonAttachments drops the references taken by claimAttachment after
+// sending a message failed. Files of the given tus uploads are kept, the
+// uploads still own them.
+func abandonAttachments(attachments []models.Attachment, uploaded map[string]bool) {
+	for _, attachment := range attachments {
+		if !uploaded[attachment.File] {
+			releaseUpload(attachment.File)
+			continue
+		}
+
+		if _, err := models.ReleaseBlob(DB, attachment.File); err != nil {
+			log.WithFields(log.Fields{"file": attachment.File, "error": err}).Error("SQL error while releasing file")
+		}
+	}
+}
+
+// buildMessage validates the form fields once all of them have been read
+func (s *messageSend) buildMessage() *httpresponse.HttpResponse {
+	if s.msgBuilt {
+		return nil
+	}
+
+	var err error
+	if s.msg, err = buildMessage(s.user, s.fields); err != nil {
+		return sendFailure(httpresponse.BadRequest(err.Error()))
+	}
+	s.msgBuilt = true
+
+	return nil
+}
+
+// readForm reads the form fields and stores the uploaded files
+func (s *messageSend) readForm(reader *multipart.Reader) *httpresponse.HttpResponse {
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Warn("Failed to read multipart form for message sending")
+			return sendFailure(httpresponse.BadRequest("Failed to parse multipart form"))
+		}
+
+		failure := s.readPart(part)
+		part.Close()
+		if failure != nil {
+			return failure
+		}
+	}
+
+	return s.buildMessage()
+}
+
+func (s *messageSend) readPart(part *multipart.Part) *httpresponse.HttpResponse {
+	if part.FileName() == "" {
+		if s.msgBuilt {
+			return sendFailure(httpresponse.BadRequest("The files have to be the last parts of the form"))
+		}
+
+		value, err := readMessageField(part)
+		if err != nil {
+			return sendFailure(httpresponse.BadRequest(fmt.Sprintf("Could not read field %s: %s", part.FormName(), err)))
+		}
+
+		s.fields[part.FormName()] = value
+		return nil
+	}
+
+	if part.FormName() != "sendfile" {
+		return sendFailure(httpresponse.BadRequest(fmt.Sprintf("Unexpected file %s", part.FormName())))
+	}
+
+	// Validate everything before accepting the first file body
+	if failure := s.buildMessage(); failure != nil {
+		return failure
+	}
+
+	if !allowsAttachments(s.msg.ContentType) {
+		return sendFailure(httpresponse.BadRequest("File uploads are only allowed for file messages"))
+	}
+
+	if len(s.attachments) >= maxAttachments {
+		return sendFailure(httpresponse.BadRequest(fmt.Sprintf("At most %d files can be attached to a message", maxAttachments)))
+	}
+
+	if !s.limits.Allows(s.usage, 0) {
+		return sendFailure(quotaExceeded())
+	}
+
+	// Whichever is smaller, the upload size limit or the remaining quota,
+	// limits the file
+	readLimit := s.uploadLimit
+	if s.msg.ContentType == models.ContentTypeClipboard && readLimit > maxClipboardImageSize {
+		readLimit = maxClipboardImageSize
+	}
+
+	quotaBound := false
+	if remaining, limited := s.limits.RemainingBytes(s.usage); limited && remaining < readLimit {
+		readLimit = remaining
+		quotaBound = true
+	}
+
+	key := uuid.NewV4().String()
+	attachment, err := storeUpload(s.user.ID, key, newUploadLimitReader(part, readLimit), part.FileName())
+	if err != nil {
+		deleteUpload(key)
+
+		if err == errUploadTooLarge {
+			if quotaBound {
+				return sendFailure(quotaExceeded())
+			}
+
+			return sendFailure(httpresponse.Error(http.StatusRequestEntityTooLarge, "Upload too large"))
+		}
+
+		log.WithFields(log.Fields{"file": key, "error": err}).Error("Storing uploaded file failed")
+		return sendFailure(httpresponse.InternalServerError("File upload failed"))
+	}
+
+	s.stored[key] = true
+	s.attachments = append(s.attachments, *attachment)
+	s.usage.Bytes += attachment.Size
+	s.usage.Files++
+
+	return nil
+}
+
+// checkRecipients validates the destination device and the message keys of
+// encrypted messages
+func (s *messageSend) checkRecipients() *httpresponse.HttpResponse {
+	s.destination = s.fields["dest_id"]
+	if s.destination != "" && s.msg.ContentType == models.ContentTypeClipboard {
+		return sendFailure(httpresponse.BadRequest("Clipboard entries are synced to all devices"))
+	}
+
+	if s.destination != "" {
+		destination, err := models.FindDevice(DB, s.destination)
+		if err != nil || destination.UserID != s.user.ID {
+			return sendFailure(httpresponse.BadRequest("No such destination device"))
+		}
+	}
+
+	if s.msg.ContentType == models.ContentTypeEncrypted {
+		var err error
+		if s.wrappedKeys, err = parseWrappedKeys(s.user, s.fields["keys"], s.destination); err != nil {
+			return sendFailure(httpresponse.BadRequest(err.Error()))
+		}
+	}
+
+	s.uploadIDs = splitList(s.fields["upload_id"])
+	if len(s.attachments)+len(s.uploadIDs)+len(splitList(s.fields["sha256"])) > maxAttachments {
+		return sendFailure(httpresponse.BadRequest(fmt.Sprintf("At most %d files can be attached to a message", maxAttachments)))
+	}
+
+	return nil
+}
+
+// collectUploads attaches the files previously uploaded via tus. They stay
+// untouched until the message has been stored, only then the uploads are
+// consumed.
+func (s *messageSend) collectUploads() *httpresponse.HttpResponse {
+	for _, uploadID := range s.uploadIDs {
+		// An upload listed twice would end up as two attachments sharing one
+		// file which is released twice when sending fails
+		upload, err := models.FindUpload(DB, uploadID)
+		if err != nil || upload.UserID != s.user.ID || !upload.Completed || s.uploaded[upload.ID] {
+			return sendFailure(httpresponse.BadRequest("No such completed upload"))
+		}
+
+		if !s.limits.Allows(s.usage, upload.Length) {
+			return sendFailure(quotaExceeded())
+		}
+
+		s.uploaded[upload.ID] = true
+		s.attachments = append(s.attachments, models.Attachment{
+			File:     upload.ID,
+			FileName: upload.FileName,
+			MimeType: upload.MimeType,
+			Size:     upload.Length,
+			SHA256:   upload.SHA256,
+		})
+		s.usage.Bytes += upload.Length
+		s.usage.Files++
+	}
+
+	return nil
+}
+
+// collectReferences attaches the files the user sent before, referenced by
+// their hash
+func (s *messageSend) collectReferences() *httpresponse.HttpResponse {
+	hashes := splitList(strings.ToLower(s.fields["sha256"]))
+
+	for _, hash := range hashes {
+		previous, err := models.FindUserAttachmentBySHA256(DB, s.user.ID, hash)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				log.WithFields(log.Fields{"user": s.user.ID, "sha256": hash, "error": err}).Error("SQL error while finding attachment by hash")
+			}
+
+			return sendFailure(httpresponse.NotFound("Unknown file, please upload it"))
+		}
+
+		if !s.limits.Allows(s.usage, previous.Size) {
+			return sendFailure(quotaExceeded())
+		}
+
+		// A new name can only be given when referencing a single file
+		fileName := previous.FileName
+		if len(hashes) == 1 && s.fields["file_name"] != "" {
+			fileName = s.fields["file_name"]
+		}
+
+		s.attachments = append(s.attachments, models.Attachment{
+			File:          previous.File,
+			FileName:      fileName,
+			MimeType:      previous.MimeType,
+			Size:          previous.Size,
+			SHA256:        previous.SHA256,
+			ScanStatus:    previous.ScanStatus,
+			ScanSignature: previous.ScanSignature,
+		})
+		s.usage.Bytes += previous.Size
+		s.usage.Files++
+	}
+
+	return nil
+}
+
+// checkAttachments validates the collected attachments against the content
+// type
+func (s *messageSend) checkAttachments() *httpresponse.HttpResponse {
+	if s.msg.ContentType == models.ContentTypeFile && len(s.attachments) == 0 {
+		return sendFailure(httpresponse.BadRequest("Message type file selected without uploading file"))
+	}
+
+	if s.msg.ContentType == models.ContentTypeClipboard {
+		if err := validateClipboard(s.msg, s.attachments); err != nil {
+			return sendFailure(httpresponse.BadRequest(err.Error()))
+		}
+	}
+
+	// Encrypted files look like random data, so whatever their names and
+	// extensions suggest is meaningless. The names would still give away what
+	// the message is about, they are dropped as well. Senders keep them in the
+	// ciphertext.
+	if s.msg.ContentType == models.ContentTypeEncrypted {
+		for i := range s.attachments {
+			s.attachments[i].FileName = ""
+			s.attachments[i].MimeType = "application/octet-stream"
+		}
+	}
+
+	return nil
+}
+
+// isNew reports whether the file was stored by this request or uploaded via
+// tus for it, as opposed to a file sent before
+func (s *messageSend) isNew(file string) bool {
+	return s.stored[file] || s.uploaded[file]
+}
+
+// scan checks the new files for malware. Referenced ones were scanned when
+// they were first sent. Infected files are moved to the quarantine.
+func (s *messageSend) scan() *httpresponse.HttpResponse {
+	for i := range s.attachments {
+		if !s.isNew(s.attachments[i].File) {
+			continue
+		}
+
+		if err := scanUpload(&s.attachments[i]); err != nil {
+			log.WithFields(log.Fields{"file": s.attachments[i].File, "error": err}).Error("Scanning uploaded file failed")
+			return sendFailure(httpresponse.Error(http.StatusServiceUnavailable, "Could not scan uploaded files"))
+		}
+
+		if !s.attachments[i].Infected() {
+			continue
+		}
+		s.infected = true
+
+		original := s.attachments[i].File
+		if err := quarantineAttachment(&s.attachments[i]); err != nil {
+			log.WithFields(log.Fields{"file": original, "error": err}).Error("Could not quarantine infected file")
+			return sendFailure(httpresponse.InternalServerError("Sending the message failed"))
+		}
+
+		// The quarantined copy belongs to this request like any other
+		// stored file until the message is created
+		s.stored[s.attachments[i].File] = true
+		if s.stored[original] {
+			delete(s.stored, original)
+			deleteUpload(original)
+		} else {
+			s.redundant = append(s.redundant, original)
+		}
+	}
+
+	return nil
+}
+
+// lockUploads keeps a concurrent request from attaching the same uploads
+// until the message is stored
+func (s *messageSend) lockUploads() *httpresponse.HttpResponse {
+	if len(s.uploadIDs) == 0 {
+		return nil
+	}
+
+	var err error
+	if s.tx, err = DB.Begin(); err != nil {
+		log.WithFields(log.Fields{"user": s.user.ID, "error": err}).Error("Could not start transaction")
+		return sendFailure(httpresponse.InternalServerError("Sending the message failed"))
+	}
+
+	if err := models.LockUploads(s.tx, s.user.ID, s.uploadIDs); err != nil {
+		if err != sql.ErrNoRows {
+			log.WithFields(log.Fields{"user": s.user.ID, "error": err}).Error("SQL error while locking uploads")
+		}
+		return sendFailure(httpresponse.BadRequest("No such completed upload"))
+	}
+
+	return nil
+}
+
+// claim registers the references to the files of the attachments, switching
+// them over to already stored copies with the same content
+func (s *messageSend) claim() *httpresponse.HttpResponse {
+	for i := range s.attachments {
+		attachment := &s.attachments[i]
+		attachment.Position = i
+
+		// Infected files are quarantined: they are never shared with other
+		// uploads and only kept for inspection until the message expires
+		if attachment.Infected() {
+			s.claimed = i + 1
+			continue
+		}
+
+		// Files referenced by their hash are stored already
+		duplicate := ""
+		var err error
+		if s.isNew(attachment.File) {
+			duplicate, err = claimAttachment(attachment)
+		} else {
+			err = claimExistingAttachment(attachment)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"file": attachment.File, "error": err}).Error("Could not claim uploaded file")
+			return sendFailure(httpresponse.InternalServerError("Sending the message failed"))
+		}
+		s.claimed = i + 1
+
+		// Only the copies of tus uploads have to wait for the uploads to be
+		// consumed
+		if duplicate != "" {
+			if s.uploaded[duplicate] {
+				s.redundant = append(s.redundant, duplicate)
+			} else {
+				deleteUpload(duplicate)
+			}
+		}
+	}
+
+	return nil
+}
+
+// store creates the message with its attachments and consumes the uploads
+func (s *messageSend) store() *httpresponse.HttpResponse {
+	s.msg.Attachments = s.attachments
+	if len(s.attachments) > 0 {
+		s.msg.File = s.attachments[0].File
+		s.msg.FileName = s.attachments[0].FileName
+	}
+
+	if err := s.msg.Create(DB); err != nil {
+		log.WithFields(log.Fields{"user": s.user.ID, "error": err}).Error("SQL error while creating message")
+		return sendFailure(httpresponse.InternalServerError("Sending the message failed"))
+	}
+	s.created = true
+
+	for i := range s.msg.Attachments {
+		s.msg.Attachments[i].MessageID = s.msg.ID
+		if err := s.msg.Attachments[i].Create(DB, s.user.ID); err != nil {
+			log.WithFields(log.Fields{"msg": s.msg.ID, "file": s.msg.Attachments[i].File, "error": err}).Error("Could not store attachment")
+			return sendFailure(httpresponse.InternalServerError("Sending the message failed"))
+		}
+	}
+
+	// From here on the files of the uploads belong to the message
+	if s.tx != nil {
+		err := models.ConsumeUploads(s.tx, s.uploadIDs)
+		if err == nil {
+			err = s.tx.Commit()
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"msg": s.msg.ID, "error": err}).Error("SQL error while consuming uploads")
+			return sendFailure(httpresponse.InternalServerError("Sending the message failed"))
+		}
+
+		s.tx = nil
+	}
+	s.consumed = true
+
+	for _, duplicate := range s.redundant {
+		deleteUpload(duplicate)
+	}
+	s.redundant = nil
+
+	return nil
+}
+
+// deliver hands the message to the destination device or to all devices of
+// the user. Messages with infected files are kept from the devices.
+func (s *messageSend) deliver() *httpresponse.HttpResponse {
+	if s.infected {
+		return nil
+	}
+
+	if s.destination != "" {
+		received := sendMessageToDevice(s.msg, s.destination, s.wrappedKeys[s.destination])
+		if received == nil {
+			return sendFailure(httpresponse.InternalServerError("Sending the message failed"))
+		}
+
+		s.delivered = append(s.delivered, received)
+		return nil
+	}
+
+	if err := s.user.LoadDevices(DB); err != nil {
+		log.WithFields(log.Fields{"user": s.user.ID, "error": err}).Error("SQL error upon loading a users devices")
+		return sendFailure(httpresponse.InternalServerError("Sending the message failed"))
+	}
+
+	for _, device := range s.user.Devices {
+		// Devices without a key could not decrypt the message anyway
+		if s.msg.ContentType == models.ContentTypeEncrypted && s.wrappedKeys[device.ID] == "" {
+			continue
+		}
+
+		// The clipboard was copied on the sending device
+		if s.msg.ContentType == models.ContentTypeClipboard && device.ID == s.msg.DeviceID {
+			continue
+		}
+
+		received := sendMessageToDevice(s.msg, device.ID, s.wrappedKeys[device.ID])
+		if received == nil {
+			return sendFailure(httpresponse.InternalServerError(fmt.Sprintf("Sending the message to the device %s failed", device.Name)))
+		}
+
+		s.delivered = append(s.delivered, received)
+	}
+
+	return nil
+}
+
+func writeMessageSent(resp http.ResponseWriter, msg models.Message) {
+	if len(msg.Attachments) > 0 {
+		updateStorageUsage(msg.UserID)
+		for i := range msg.Attachments {
+			queueThumbnails(msg.UserID, &msg.Attachments[i])
+		}
+	}
+
+	if msg.ContentType == models.ContentTypeClipboard {
+		syncClipboard(msg)
+	}
+
+	if msg.ContentType == models.ContentTypeURL {
+		queueUnfurl(msg)
+	}
+
+	data := map[string]interface{}{
+		"message_id": msg.ID,
+	}
+
+	// Only the sender learns the secret to verify the callbacks with
+	if msg.CallbackSecret != "" {
+		data["callback_secret"] = msg.CallbackSecret
+	}
+
+	response := httpresponse.Success("Message sent")
+	response.Data = data
+	response.WriteJSON(resp)
+}
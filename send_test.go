@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/irrenhaus/pushmearound_server/models"
+	"github.com/irrenhaus/pushmearound_server/storage"
+)
+
+type testMessageSent struct {
+	MessageID uint `json:"message_id"`
+}
+
+// storedBlobs lists the keys in the blob storage
+func storedBlobs(t *testing.T) []string {
+	keys := []string{}
+	err := BlobStorage.Walk(func(info storage.Info) error {
+		keys = append(keys, info.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keys
+}
+
+func TestSendFiles(t *testing.T) {
+	setupTestDatabase(t)
+
+	user, devices := createTestUser(t, "sender", 2)
+
+	req := newSendRequest(t, map[string]string{
+		"device_id":    devices[0].ID,
+		"content_type": fmt.Sprint(models.ContentTypeFile),
+	}, testFile{"a.txt", "first"}, testFile{"b.txt", "second"})
+
+	sent := testMessageSent{}
+	decodeResponse(t, serveAs(user, SendMessageHandler, "POST", "/msg/send", req), 200, &sent)
+
+	attachments, err := models.FindAttachmentsByMessages(DB, []uint{sent.MessageID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attachments) != 2 || attachments[0].FileName != "a.txt" || attachments[1].FileName != "b.txt" {
+		t.Fatalf("Stored attachments %+v", attachments)
+	}
+
+	if keys := storedBlobs(t); len(keys) != 2 {
+		t.Errorf("Stored files %v, want 2", keys)
+	}
+
+	for _, device := range devices {
+		if _, err := models.FindReceivedMessageByMessageAndDevice(DB, sent.MessageID, device.ID); err != nil {
+			t.Errorf("%s didn't receive the message: %s", device.Name, err)
+		}
+	}
+}
+
+func TestSendFailureDiscardsFiles(t *testing.T) {
+	setupTestDatabase(t)
+
+	user, devices := createTestUser(t, "sender", 1)
+
+	// The destination is only checked once all files have been stored
+	req := newSendRequest(t, map[string]string{
+		"device_id":    devices[0].ID,
+		"content_type": fmt.Sprint(models.ContentTypeFile),
+		"dest_id":      "no-such-device",
+	}, testFile{"a.txt", "first"}, testFile{"b.txt", "second"})
+
+	decodeResponse(t, serveAs(user, SendMessageHandler, "POST", "/msg/send", req), 400, nil)
+
+	if keys := storedBlobs(t); len(keys) != 0 {
+		t.Errorf("Files %v were left behind", keys)
+	}
+
+	messages, err := models.FindMessagesByDevice(DB, devices[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 0 {
+		t.Errorf("%d messages were stored", len(messages))
+	}
+}
+
+func TestSendMarkdownMessage(t *testing.T) {
+	setupTestDatabase(t)
+
+	user, devices := createTestUser(t, "writer", 1)
+
+	req := newSendRequest(t, map[string]string{
+		"device_id":    devices[0].ID,
+		"content_type": fmt.Sprint(models.ContentTypeMessage),
+		"format":       models.FormatMarkdown,
+		"text":         "**Hello** <script>alert(1)</script>",
+	})
+
+	sent := testMessageSent{}
+	decodeResponse(t, serveAs(user, SendMessageHandler, "POST", "/msg/send", req), 200, &sent)
+
+	msg, err := models.FindMessage(DB, sent.MessageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Format != models.FormatMarkdown || !strings.Contains(msg.HTML, "<strong>Hello</strong>") || strings.Contains(msg.HTML, "<script") {
+		t.Errorf("Stored as %q, rendered as %q", msg.Format, msg.HTML)
+	}
+}
+
+func TestSendEncryptedDropsFileNames(t *testing.T) {
+	setupTestDatabase(t)
+
+	user, devices := createTestUser(t, "secretive", 1)
+	if err := devices[0].UpdatePublicKey(DB, "cHVibGljIGtleQ=="); err != nil {
+		t.Fatal(err)
+	}
+
+	fields := map[string]string{
+		"device_id":    devices[0].ID,
+		"content_type": fmt.Sprint(models.ContentTypeEncrypted),
+		"ciphertext":   "Y2lwaGVydGV4dA==",
+		"keys":         fmt.Sprintf(`{%q: "d3JhcHBlZA=="}`, devices[0].ID),
+	}
+
+	req := newSendRequest(t, fields, testFile{"merger-plans.pdf", "random looking data"})
+	sent := testMessageSent{}
+	decodeResponse(t, serveAs(user, SendMessageHandler, "POST", "/msg/send", req), 200, &sent)
+
+	msg, err := models.FindMessage(DB, sent.MessageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.FileName != "" {
+		t.Errorf("The message is named %q", msg.FileName)
+	}
+
+	attachments, err := models.FindAttachmentsByMessages(DB, []uint{sent.MessageID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attachments) != 1 || attachments[0].FileName != "" || attachments[0].MimeType != "application/octet-stream" {
+		t.Errorf("Stored attachments %+v", attachments)
+	}
+
+	// Nor can a name be given for a file sent before
+	fields["sha256"] = attachments[0].SHA256
+	fields["file_name"] = "merger-plans.pdf"
+	req = newSendRequest(t, fields)
+	decodeResponse(t, serveAs(user, SendMessageHandler, "POST", "/msg/send", req), 400, nil)
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Local stores blobs in a directory tree below Root. Blobs are sharded into
+// sub directories by the first four characters of their key so that no single
+// directory grows too large.
+type Local struct {
+	Root string
+}
+
+func NewLocal(root string) (*Local, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	return &Local{Root: root}, nil
+}
+
+func (l *Local) path(key string) string {
+	if len(key) < 4 {
+		return filepath.Join(l.Root, key)
+	}
+
+	return filepath.Join(l.Root, key[0:2], key[2:4], key)
+}
+
+// find returns the path a blob is stored at. Uploads written before sharding
+// was introduced live directly in the root directory.
+func (l *Local) find(key string) (string, error) {
+	path := l.path(key)
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	legacy := filepath.Join(l.Root, key)
+	if _, err := os.Stat(legacy); err != nil {
+		if os.IsNotExist(err) {
+			return "", ErrNotFound
+		}
+		return "", err
+	}
+
+	return legacy, nil
+}
+
+func (l *Local) Put(key string, r io.Reader) (int64, error) {
+	path := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+
+	// Write to a temporary file first so that nobody ever sees a partial blob
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return n, err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return n, err
+	}
+
+	return n, nil
+}
+
+func (l *Local) Get(key string) (Blob, error) {
+	path, err := l.find(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(path)
+}
+
+func (l *Local) Stat(key string) (Info, error) {
+	path, err := l.find(key)
+	if err != nil {
+		return Info{}, err
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return Info{}, err
+	}
+
+	return Info{
+		Key:     key,
+		Size:    stat.Size(),
+		ModTime: stat.ModTime(),
+	}, nil
+}
+
+func (l *Local) Delete(key string) error {
+	path, err := l.find(key)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+func (l *Local) Walk(fn func(Info) error) error {
+	return filepath.Walk(l.Root, func(path string, stat os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Skip directories and partially written blobs
+		if stat.IsDir() || strings.HasPrefix(stat.Name(), ".upload-") {
+			return nil
+		}
+
+		return fn(Info{
+			Key:     stat.Name(),
+			Size:    stat.Size(),
+			ModTime: stat.ModTime(),
+		})
+	})
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// Memory keeps all blobs in memory. It is meant for tests and development.
+type Memory struct {
+	mutex sync.RWMutex
+	blobs map[string]memoryBlob
+}
+
+type memoryBlob struct {
+	data    []byte
+	modTime time.Time
+}
+
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (r memoryReader) Close() error {
+	return nil
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		blobs: map[string]memoryBlob{},
+	}
+}
+
+func (m *Memory) Put(key string, r io.Reader) (int64, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return int64(len(data)), err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.blobs[key] = memoryBlob{
+		data:    data,
+		modTime: time.Now(),
+	}
+
+	return int64(len(data)), nil
+}
+
+func (m *Memory) Get(key string) (Blob, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	blob, ok := m.blobs[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return memoryReader{bytes.NewReader(blob.data)}, nil
+}
+
+func (m *Memory) Stat(key string) (Info, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	blob, ok := m.blobs[key]
+	if !ok {
+		return Info{}, ErrNotFound
+	}
+
+	return Info{
+		Key:     key,
+		Size:    int64(len(blob.data)),
+		ModTime: blob.modTime,
+	}, nil
+}
+
+func (m *Memory) Delete(key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.blobs[key]; !ok {
+		return ErrNotFound
+	}
+
+	delete(m.blobs, key)
+	return nil
+}
+
+func (m *Memory) Walk(fn func(Info) error) error {
+	m.mutex.RLock()
+	infos := []Info{}
+	for key, blob := range m.blobs {
+		infos = append(infos, Info{
+			Key:     key,
+			Size:    int64(len(blob.data)),
+			ModTime: blob.modTime,
+		})
+	}
+	m.mutex.RUnlock()
+
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,354 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config configures the S3 driver. Endpoint may point to any S3 compatible
+// service, e.g. "https://s3.eu-central-1.amazonaws.com" or a local MinIO at
+// "http://localhost:9000". Buckets are always addressed path-style.
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+}
+
+// S3 stores blobs in a bucket of an S3 compatible object store. Requests are
+// signed with AWS Signature Version 4.
+type S3 struct {
+	config S3Config
+	client *http.Client
+}
+
+func NewS3(config S3Config) (*S3, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, errors.New("S3 storage needs an endpoint and a bucket")
+	}
+
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+
+	config.Endpoint = strings.TrimRight(config.Endpoint, "/")
+
+	return &S3{
+		config: config,
+		client: &http.Client{},
+	}, nil
+}
+
+func (s *S3) objectURL(key string) string {
+	path := (&url.URL{Path: "/" + s.config.Bucket + "/" + key}).EscapedPath()
+	return s.config.Endpoint + path
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign adds the AWS Signature Version 4 headers to the request. payloadHash is
+// the hex encoded SHA-256 of the request body.
+func (s *S3) sign(req *http.Request, payloadHash string) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-date":           amzDate,
+		"x-amz-content-sha256": payloadHash,
+	}
+	if r := req.Header.Get("Range"); r != "" {
+		headers["range"] = r
+	}
+
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + strings.TrimSpace(headers[name]) + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretKey), date)
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.config.AccessKey, scope, signedHeaders, signature))
+}
+
+var emptyPayloadHash = hex.EncodeToString(sha256.New().Sum(nil))
+
+func (s *S3) do(method string, key string, header http.Header) (*http.Response, error) {
+	return s.request(method, s.objectURL(key), header)
+}
+
+func (s *S3) request(method string, rawURL string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	s.sign(req, emptyPayloadHash)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+
+	if resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("S3 %s %s failed: %s", method, req.URL.Path, resp.Status)
+	}
+
+	return resp, nil
+}
+
+// Put spools the blob to a temporary file first. S3 needs to know the length
+// and hash of the body before the upload starts.
+func (s *S3) Put(key string, r io.Reader) (int64, error) {
+	tmp, err := ioutil.TempFile("", "pushmearound-s3-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if err != nil {
+		return size, err
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return size, err
+	}
+
+	req, err := http.NewRequest("PUT", s.objectURL(key), ioutil.NopCloser(tmp))
+	if err != nil {
+		return size, err
+	}
+	req.ContentLength = size
+
+	s.sign(req, hex.EncodeToString(hash.Sum(nil)))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return size, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return size, fmt.Errorf("S3 PUT %s failed: %s", key, resp.Status)
+	}
+
+	return size, nil
+}
+
+func (s *S3) Get(key string) (Blob, error) {
+	info, err := s.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Blob{s3: s, key: key, size: info.Size}, nil
+}
+
+func (s *S3) Stat(key string) (Info, error) {
+	resp, err := s.do("HEAD", key, nil)
+	if err != nil {
+		return Info{}, err
+	}
+	resp.Body.Close()
+
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return Info{}, err
+	}
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	return Info{
+		Key:     key,
+		Size:    size,
+		ModTime: modTime,
+	}, nil
+}
+
+func (s *S3) Delete(key string) error {
+	resp, err := s.do("DELETE", key, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key          string
+		LastModified time.Time
+		Size         int64
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// Walk lists the bucket using ListObjectsV2, one page at a time
+func (s *S3) Walk(fn func(Info) error) error {
+	token := ""
+
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		bucketURL := s.config.Endpoint + (&url.URL{Path: "/" + s.config.Bucket}).EscapedPath() + "?" + query.Encode()
+
+		resp, err := s.request("GET", bucketURL, nil)
+		if err != nil {
+			return err
+		}
+
+		var result s3ListBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, object := range result.Contents {
+			err := fn(Info{
+				Key:     object.Key,
+				Size:    object.Size,
+				ModTime: object.LastModified,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// s3Blob lazily opens a ranged GET request starting at the current offset
+// whenever it is read after a seek
+type s3Blob struct {
+	s3     *S3
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (b *s3Blob) Read(p []byte) (int, error) {
+	if b.offset >= b.size {
+		return 0, io.EOF
+	}
+
+	if b.body == nil {
+		header := http.Header{}
+		header.Set("Range", fmt.Sprintf("bytes=%d-", b.offset))
+
+		resp, err := b.s3.do("GET", b.key, header)
+		if err != nil {
+			return 0, err
+		}
+		b.body = resp.Body
+	}
+
+	n, err := b.body.Read(p)
+	b.offset += int64(n)
+
+	return n, err
+}
+
+func (b *s3Blob) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = b.offset + offset
+	case io.SeekEnd:
+		abs = b.size + offset
+	default:
+		return b.offset, errors.New("Invalid whence")
+	}
+
+	if abs < 0 {
+		return b.offset, errors.New("Negative position")
+	}
+
+	if abs != b.offset && b.body != nil {
+		b.body.Close()
+		b.body = nil
+	}
+	b.offset = abs
+
+	return abs, nil
+}
+
+func (b *s3Blob) Close() error {
+	if b.body != nil {
+		return b.body.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a minimal S3 compatible object store serving a single bucket. It
+// checks that requests are signed and lists the bucket in small pages so that
+// the pagination of Walk is exercised.
+type fakeS3 struct {
+	t        *testing.T
+	bucket   string
+	pageSize int
+
+	mutex   sync.Mutex
+	objects map[string][]byte
+	written map[string]time.Time
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	return &fakeS3{
+		t:        t,
+		bucket:   "blobs",
+		pageSize: 2,
+		objects:  map[string][]byte{},
+		written:  map[string]time.Time{},
+	}
+}
+
+func (f *fakeS3) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+		http.Error(resp, "unsigned request", http.StatusForbidden)
+		return
+	}
+
+	if req.URL.Path == "/"+f.bucket {
+		f.list(resp, req)
+		return
+	}
+
+	if !strings.HasPrefix(req.URL.Path, "/"+f.bucket+"/") {
+		http.NotFound(resp, req)
+		return
+	}
+	key := strings.TrimPrefix(req.URL.Path, "/"+f.bucket+"/")
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	switch req.Method {
+	case "PUT":
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		hash := sha256.Sum256(data)
+		if req.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(hash[:]) {
+			http.Error(resp, "payload hash mismatch", http.StatusBadRequest)
+			return
+		}
+
+		f.objects[key] = data
+		f.written[key] = time.Now()
+
+	case "HEAD", "GET":
+		data, ok := f.objects[key]
+		if !ok {
+			http.NotFound(resp, req)
+			return
+		}
+
+		resp.Header().Set("Last-Modified", f.written[key].UTC().Format(http.TimeFormat))
+
+		status := http.StatusOK
+		if r := req.Header.Get("Range"); r != "" {
+			start, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r, "bytes="), "-"))
+			if err != nil || start >= len(data) {
+				http.Error(resp, "invalid range", http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			resp.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(data)-1, len(data)))
+			data = data[start:]
+			status = http.StatusPartialContent
+		}
+
+		resp.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		resp.WriteHeader(status)
+		if req.Method == "GET" {
+			resp.Write(data)
+		}
+
+	case "DELETE":
+		// Like S3, deleting a missing object succeeds
+		delete(f.objects, key)
+		resp.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type fakeS3Object struct {
+	Key          string
+	LastModified time.Time
+	Size         int64
+}
+
+func (f *fakeS3) list(resp http.ResponseWriter, req *http.Request) {
+	if req.URL.Query().Get("list-type") != "2" {
+		http.Error(resp, "only ListObjectsV2 is supported", http.StatusBadRequest)
+		return
+	}
+
+	f.mutex.Lock()
+	keys := []string{}
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// The continuation token is simply the last key of the previous page
+	after := req.URL.Query().Get("continuation-token")
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []fakeS3Object
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}{}
+
+	for _, key := range keys {
+		if key <= after {
+			continue
+		}
+
+		if len(result.Contents) == f.pageSize {
+			result.IsTruncated = true
+			result.NextContinuationToken = result.Contents[len(result.Contents)-1].Key
+			break
+		}
+
+		result.Contents = append(result.Contents, fakeS3Object{
+			Key:          key,
+			LastModified: f.written[key],
+			Size:         int64(len(f.objects[key])),
+		})
+	}
+	f.mutex.Unlock()
+
+	resp.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(resp).Encode(result)
+}
+
+func newTestS3(t *testing.T) Storage {
+	server := httptest.NewServer(newFakeS3(t))
+	t.Cleanup(server.Close)
+
+	s, err := NewS3(S3Config{
+		Endpoint:  server.URL + "/",
+		Bucket:    "blobs",
+		AccessKey: "access",
+		SecretKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestS3(t *testing.T) {
+	runStorageTests(t, newTestS3)
+}
+
+func TestS3Config(t *testing.T) {
+	if _, err := NewS3(S3Config{Bucket: "blobs"}); err == nil {
+		t.Error("NewS3 accepted a config without endpoint")
+	}
+	if _, err := NewS3(S3Config{Endpoint: "http://localhost:9000"}); err == nil {
+		t.Error("NewS3 accepted a config without bucket")
+	}
+}
+
+func TestS3Errors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		http.Error(resp, "broken", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	s, err := NewS3(S3Config{Endpoint: server.URL, Bucket: "blobs", AccessKey: "access", SecretKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Put("key", strings.NewReader("data")); err == nil {
+		t.Error("Put succeeded although the server failed")
+	}
+	if _, err := s.Stat("key"); err == nil || err == ErrNotFound {
+		t.Errorf("Stat returned %v, want a server error", err)
+	}
+	if err := s.Walk(func(Info) error { return nil }); err == nil {
+		t.Error("Walk succeeded although the server failed")
+	}
+}
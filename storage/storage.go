@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+var ErrNotFound = errors.New("No such blob")
+
+// Blob is an open stored file. Seeking is supported so that downloads can be
+// resumed at arbitrary offsets.
+type Blob interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+type Info struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage stores uploaded files under opaque keys
+type Storage interface {
+	// Put stores everything read from r under key and returns the number of
+	// bytes written
+	Put(key string, r io.Reader) (int64, error)
+	Get(key string) (Blob, error)
+	Stat(key string) (Info, error)
+	Delete(key string) error
+	// Walk calls fn for every stored blob and stops at the first error
+	Walk(fn func(Info) error) error
+}
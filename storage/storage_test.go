@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// storageTests run against every driver, each one with an empty storage
+var storageTests = []struct {
+	name string
+	run  func(t *testing.T, s Storage)
+}{
+	{"PutGet", testPutGet},
+	{"PutOverwrites", testPutOverwrites},
+	{"GetSeek", testGetSeek},
+	{"Stat", testStat},
+	{"Missing", testMissing},
+	{"Delete", testDelete},
+	{"Walk", testWalk},
+	{"WalkStops", testWalkStops},
+}
+
+func runStorageTests(t *testing.T, newStorage func(t *testing.T) Storage) {
+	for _, test := range storageTests {
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, newStorage(t))
+		})
+	}
+}
+
+func put(t *testing.T, s Storage, key string, data string) {
+	n, err := s.Put(key, strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("Put(%q): %s", key, err)
+	}
+	if n != int64(len(data)) {
+		t.Fatalf("Put(%q) wrote %d bytes, want %d", key, n, len(data))
+	}
+}
+
+func get(t *testing.T, s Storage, key string) string {
+	blob, err := s.Get(key)
+	if err != nil {
+		t.Fatalf("Get(%q): %s", key, err)
+	}
+	defer blob.Close()
+
+	data, err := ioutil.ReadAll(blob)
+	if err != nil {
+		t.Fatalf("Reading %q: %s", key, err)
+	}
+
+	return string(data)
+}
+
+func testPutGet(t *testing.T, s Storage) {
+	put(t, s, "0f1e2d3c-first", "hello world")
+	put(t, s, "0f1e2d3c-empty", "")
+
+	if data := get(t, s, "0f1e2d3c-first"); data != "hello world" {
+		t.Errorf("Get returned %q, want %q", data, "hello world")
+	}
+	if data := get(t, s, "0f1e2d3c-empty"); data != "" {
+		t.Errorf("Get of an empty blob returned %q", data)
+	}
+}
+
+func testPutOverwrites(t *testing.T, s Storage) {
+	put(t, s, "a1b2c3d4", "old contents")
+	put(t, s, "a1b2c3d4", "new")
+
+	if data := get(t, s, "a1b2c3d4"); data != "new" {
+		t.Errorf("Get returned %q after overwriting, want %q", data, "new")
+	}
+}
+
+func testGetSeek(t *testing.T, s Storage) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	if _, err := s.Put("seekable", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	blob, err := s.Get("seekable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+
+	tests := []struct {
+		offset int64
+		whence int
+		want   int64
+	}{
+		{5003, io.SeekStart, 5003},
+		{10, io.SeekCurrent, 5023},
+		{-7, io.SeekEnd, int64(len(data)) - 7},
+		{0, io.SeekStart, 0},
+	}
+
+	for _, test := range tests {
+		pos, err := blob.Seek(test.offset, test.whence)
+		if err != nil {
+			t.Fatalf("Seek(%d, %d): %s", test.offset, test.whence, err)
+		}
+		if pos != test.want {
+			t.Fatalf("Seek(%d, %d) = %d, want %d", test.offset, test.whence, pos, test.want)
+		}
+
+		buf := make([]byte, 10)
+		n, err := io.ReadFull(blob, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			t.Fatalf("Read at %d: %s", pos, err)
+		}
+
+		end := pos + 10
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		if !bytes.Equal(buf[:n], data[pos:end]) {
+			t.Errorf("Read at %d returned %q, want %q", pos, buf[:n], data[pos:end])
+		}
+	}
+
+	if _, err := blob.Seek(-1, io.SeekStart); err == nil {
+		t.Error("Seeking before the start succeeded")
+	}
+}
+
+func testStat(t *testing.T, s Storage) {
+	put(t, s, "deadbeef", "twelve bytes")
+
+	info, err := s.Stat("deadbeef")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Key != "deadbeef" || info.Size != 12 {
+		t.Errorf("Stat returned %+v, want key deadbeef and size 12", info)
+	}
+	if info.ModTime.IsZero() {
+		t.Error("Stat returned no modification time")
+	}
+}
+
+func testMissing(t *testing.T, s Storage) {
+	if _, err := s.Get("missing"); err != ErrNotFound {
+		t.Errorf("Get of a missing blob returned %v, want ErrNotFound", err)
+	}
+	if _, err := s.Stat("missing"); err != ErrNotFound {
+		t.Errorf("Stat of a missing blob returned %v, want ErrNotFound", err)
+	}
+
+	// Object stores don't tell whether there was anything to delete
+	if err := s.Delete("missing"); err != nil && err != ErrNotFound {
+		t.Errorf("Delete of a missing blob returned %v", err)
+	}
+}
+
+func testDelete(t *testing.T, s Storage) {
+	put(t, s, "cafebabe", "data")
+	put(t, s, "cafef00d", "other")
+
+	if err := s.Delete("cafebabe"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Stat("cafebabe"); err != ErrNotFound {
+		t.Errorf("Stat after Delete returned %v, want ErrNotFound", err)
+	}
+	if data := get(t, s, "cafef00d"); data != "other" {
+		t.Errorf("Delete touched another blob, it contains %q", data)
+	}
+}
+
+func testWalk(t *testing.T, s Storage) {
+	want := map[string]int64{}
+	for i, key := range []string{"11112222", "11113333", "2222aaaa", "3333bbbb", "x"} {
+		data := strings.Repeat("*", i+1)
+		put(t, s, key, data)
+		want[key] = int64(len(data))
+	}
+
+	got := map[string]int64{}
+	err := s.Walk(func(info Info) error {
+		if _, ok := got[info.Key]; ok {
+			t.Errorf("Walk returned %q twice", info.Key)
+		}
+		got[info.Key] = info.Size
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != len(want) {
+		t.Errorf("Walk returned %v, want %v", keys(got), keys(want))
+	}
+	for key, size := range want {
+		if got[key] != size {
+			t.Errorf("Walk returned size %d for %q, want %d", got[key], key, size)
+		}
+	}
+}
+
+func testWalkStops(t *testing.T, s Storage) {
+	for _, key := range []string{"aaaa0001", "aaaa0002", "aaaa0003"} {
+		put(t, s, key, "data")
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err := s.Walk(func(info Info) error {
+		calls++
+		return stop
+	})
+
+	if err != stop {
+		t.Errorf("Walk returned %v, want the error of fn", err)
+	}
+	if calls != 1 {
+		t.Errorf("Walk called fn %d times after it failed", calls)
+	}
+}
+
+func keys(m map[string]int64) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func TestMemory(t *testing.T) {
+	runStorageTests(t, func(t *testing.T) Storage {
+		return NewMemory()
+	})
+}
+
+func newTestLocal(t *testing.T) (*Local, string) {
+	root, err := ioutil.TempDir("", "pushmearound-storage-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	local, err := NewLocal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return local, root
+}
+
+func TestLocal(t *testing.T) {
+	runStorageTests(t, func(t *testing.T) Storage {
+		local, _ := newTestLocal(t)
+		return local
+	})
+}
+
+func TestLocalLegacyLayout(t *testing.T) {
+	local, root := newTestLocal(t)
+
+	// Uploads from before sharding live directly in the root directory
+	if err := ioutil.WriteFile(filepath.Join(root, "legacy-upload"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if data := get(t, local, "legacy-upload"); data != "old" {
+		t.Errorf("Get returned %q, want %q", data, "old")
+	}
+
+	if err := local.Delete("legacy-upload"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := local.Stat("legacy-upload"); err != ErrNotFound {
+		t.Errorf("Stat after Delete returned %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/irrenhaus/pushmearound_server/httpresponse"
+	"github.com/irrenhaus/pushmearound_server/models"
+)
+
+// Edge lengths of the generated thumbnails, the first one is the default
+var thumbnailSizes = []int{128, 512}
+
+// Images with more pixels than this are not decoded at all. A small file can
+// easily unpack to gigabytes of pixels.
+const maxThumbnailSourcePixels = 50 * 1000 * 1000
+
+// thumbnailJob is an attachment waiting for its thumbnails. The thumbnails
+// are stored for the user who sent the attachment.
+type thumbnailJob struct {
+	UserID     uint
+	Attachment models.Attachment
+}
+
+// Queued jobs wait here for the thumbnail worker. If the queue is full the
+// attachment simply stays without a thumbnail.
+var thumbnailQueue = make(chan thumbnailJob, 64)
+
+func thumbnailKey(file string, size int) string {
+	return fmt.Sprintf("%s.thumb%d", file, size)
+}
+
+// thumbnailBase returns the file a thumbnail was generated from
+func thumbnailBase(key string) (string, bool) {
+	for _, size := range thumbnailSizes {
+		suffix := fmt.Sprintf(".thumb%d", size)
+		if strings.HasSuffix(key, suffix) {
+			return strings.TrimSuffix(key, suffix), true
+		}
+	}
+
+	return "", false
+}
+
+func isThumbnailSource(mimeType string) bool {
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+
+	return false
+}
+
+// queueThumbnails schedules the thumbnail generation for an attachment
+// without blocking the request
+func queueThumbnails(userID uint, attachment *models.Attachment) {
+	if attachment == nil || !isThumbnailSource(attachment.MimeType) {
+		return
+	}
+
+	select {
+	case thumbnailQueue <- thumbnailJob{UserID: userID, Attachment: *attachment}:
+	default:
+		log.WithFields(log.Fields{"file": attachment.File}).Warn("Thumbnail queue is full, skipping thumbnail")
+	}
+}
+
+// runThumbnailer generates the queued thumbnails in the background
+func runThumbnailer() {
+	for job := range thumbnailQueue {
+		if err := generateThumbnails(job.UserID, job.Attachment); err != nil {
+			log.WithFields(log.Fields{"file": job.Attachment.File, "error": err}).Warn("Could not generate thumbnails")
+		}
+	}
+}
+
+func generateThumbnails(userID uint, attachment models.Attachment) error {
+	blob, err := openBlob(attachment.File)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	config, format, err := image.DecodeConfig(blob)
+	if err != nil {
+		return err
+	}
+
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxThumbnailSourcePixels {
+		return models.SetImageInfo(DB, attachment.File, config.Width, config.Height, false)
+	}
+
+	// Files are deduplicated, so the thumbnails might be there already
+	if _, err := BlobStorage.Stat(thumbnailKey(attachment.File, thumbnailSizes[len(thumbnailSizes)-1])); err == nil {
+		return models.SetImageInfo(DB, attachment.File, config.Width, config.Height, true)
+	}
+
+	if _, err := blob.Seek(0, 0); err != nil {
+		return err
+	}
+
+	img, _, err := image.Decode(blob)
+	if err != nil {
+		return err
+	}
+
+	for _, size := range thumbnailSizes {
+		var buf bytes.Buffer
+		thumb := scaleImage(img, size)
+
+		// Photos stay JPEG, everything else might need transparency
+		if format == "jpeg" {
+			err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 80})
+		} else {
+			err = png.Encode(&buf, thumb)
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := putBlob(userID, thumbnailKey(attachment.File, size), &buf); err != nil {
+			return err
+		}
+	}
+
+	return models.SetImageInfo(DB, attachment.File, config.Width, config.Height, true)
+}
+
+// scaleImage shrinks the image to fit into a square with the given edge
+// length by averaging all source pixels covering a target pixel. Smaller
+// images are only copied.
+func scaleImage(src image.Image, size int) *image.RGBA {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+
+	dstW, dstH := srcW, srcH
+	if srcW > size || srcH > size {
+		if srcW >= srcH {
+			dstW, dstH = size, srcH*size/srcW
+		} else {
+			dstW, dstH = srcW*size/srcH, size
+		}
+	}
+	if dstW < 1 {
+		dstW = 1
+	}
+	if dstH < 1 {
+		dstH = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0 := bounds.Min.Y + y*srcH/dstH
+		y1 := bounds.Min.Y + (y+1)*srcH/dstH
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+
+		for x := 0; x < dstW; x++ {
+			x0 := bounds.Min.X + x*srcW/dstW
+			x1 := bounds.Min.X + (x+1)*srcW/dstW
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r += uint64(pr)
+					g += uint64(pg)
+					b += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(b / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+
+	return dst
+}
+
+// deleteThumbnails removes all thumbnails of a file
+func deleteThumbnails(file string) {
+	for _, size := range thumbnailSizes {
+		deleteUpload(thumbnailKey(file, size))
+	}
+}
+
+// ThumbnailHandler serves a thumbnail of an image attachment. The size
+// parameter picks the smallest thumbnail at least as large as requested.
+func ThumbnailHandler(resp http.ResponseWriter, req *http.Request) {
+	user, ok := context.Get(req, ContextKeyUser).(models.User)
+	if !ok {
+		httpresponse.InternalServerError("Could not convert user").WriteJSON(resp)
+		return
+	}
+
+	vars := mux.Vars(req)
+	fileID := vars["id"]
+
+	size := thumbnailSizes[0]
+	if sizeParam := req.URL.Query().Get("size"); sizeParam != "" {
+		requested, err := strconv.Atoi(sizeParam)
+		if err != nil || requested <= 0 {
+			httpresponse.BadRequest("Invalid size").WriteJSON(resp)
+			return
+		}
+
+		size = thumbnailSizes[len(thumbnailSizes)-1]
+		for i := len(thumbnailSizes) - 1; i >= 0; i-- {
+			if thumbnailSizes[i] >= requested {
+				size = thumbnailSizes[i]
+			}
+		}
+	}
+
+	attachment, err := models.FindReceivedAttachment(DB, user.ID, fileID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.WithFields(log.Fields{"user": user.ID, "file": fileID, "error": err}).Error("SQL error while finding attachment")
+		}
+
+		httpresponse.NotFound("No such file").WriteJSON(resp)
+		return
+	}
+
+	if !attachment.Thumbnail {
+		httpresponse.NotFound("No thumbnail available").WriteJSON(resp)
+		return
+	}
+
+	key := thumbnailKey(attachment.File, size)
+	info, err := BlobStorage.Stat(key)
+	if err != nil {
+		log.WithFields(log.Fields{"file": key, "error": err}).Error("Could not stat thumbnail")
+		httpresponse.NotFound("No thumbnail available").WriteJSON(resp)
+		return
+	}
+
+	blob, err := openBlob(key)
+	if err != nil {
+		log.WithFields(log.Fields{"file": key, "error": err}).Error("Could not open thumbnail")
+		httpresponse.NotFound("No thumbnail available").WriteJSON(resp)
+		return
+	}
+	defer blob.Close()
+
+	resp.Header().Set("ETag", fmt.Sprintf(`"%s"`, key))
+
+	// The content type is sniffed by http.ServeContent
+	http.ServeContent(resp, req, "", info.ModTime, blob)
+}
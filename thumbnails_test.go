@@ -0,0 +1,106 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func uniformImage(rect image.Rectangle, c color.Color) *image.RGBA {
+	img := image.NewRGBA(rect)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			img.Set(x, y, c)
+		}
+	}
+
+	return img
+}
+
+func TestScaleImageKeepsAspectRatio(t *testing.T) {
+	for _, test := range []struct {
+		width, height int
+		size          int
+		dstW, dstH    int
+	}{
+		{1024, 768, 128, 128, 96},
+		{768, 1024, 128, 96, 128},
+		{512, 512, 128, 128, 128},
+		// Smaller images are only copied
+		{100, 50, 128, 100, 50},
+		// Very thin images keep at least one pixel
+		{4000, 2, 128, 128, 1},
+		{2, 4000, 128, 1, 128},
+	} {
+		src := image.NewRGBA(image.Rect(0, 0, test.width, test.height))
+		bounds := scaleImage(src, test.size).Bounds()
+
+		if bounds.Dx() != test.dstW || bounds.Dy() != test.dstH {
+			t.Errorf("%dx%d scaled to %d is %dx%d, want %dx%d", test.width, test.height, test.size, bounds.Dx(), bounds.Dy(), test.dstW, test.dstH)
+		}
+	}
+}
+
+func TestScaleImageAveragesPixels(t *testing.T) {
+	// Black and white columns average to grey
+	src := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			if x%2 == 0 {
+				src.Set(x, y, color.White)
+			} else {
+				src.Set(x, y, color.Black)
+			}
+		}
+	}
+
+	dst := scaleImage(src, 2)
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 2; x++ {
+			c := dst.RGBAAt(x, y)
+			if c.R < 126 || c.R > 128 || c.R != c.G || c.R != c.B || c.A != 255 {
+				t.Errorf("Pixel %d,%d is %v, want grey", x, y, c)
+			}
+		}
+	}
+}
+
+func TestScaleImageHonoursBounds(t *testing.T) {
+	// Only the red part of the image is passed on
+	src := uniformImage(image.Rect(0, 0, 400, 400), color.RGBA{0, 0, 255, 255})
+	red := color.RGBA{255, 0, 0, 255}
+	for y := 100; y < 300; y++ {
+		for x := 200; x < 400; x++ {
+			src.Set(x, y, red)
+		}
+	}
+
+	dst := scaleImage(src.SubImage(image.Rect(200, 100, 400, 300)), 50)
+	if bounds := dst.Bounds(); bounds != image.Rect(0, 0, 50, 50) {
+		t.Fatalf("Scaled to %v", bounds)
+	}
+
+	for y := 0; y < 50; y++ {
+		for x := 0; x < 50; x++ {
+			if c := dst.RGBAAt(x, y); c != red {
+				t.Fatalf("Pixel %d,%d is %v, want %v", x, y, c, red)
+			}
+		}
+	}
+}
+
+func TestThumbnailBase(t *testing.T) {
+	for _, size := range thumbnailSizes {
+		file, ok := thumbnailBase(thumbnailKey("some-file", size))
+		if !ok || file != "some-file" {
+			t.Errorf("Thumbnail of size %d maps back to %q, %v", size, file, ok)
+		}
+	}
+
+	if _, ok := thumbnailBase("some-file"); ok {
+		t.Error("A file is taken as thumbnail")
+	}
+	if _, ok := thumbnailBase("some-file.thumb64"); ok {
+		t.Error("A thumbnail of an unknown size is recognized")
+	}
+}
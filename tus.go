@@ -0,0 +1,424 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/irrenhaus/pushmearound_server/httpresponse"
+	"github.com/irrenhaus/pushmearound_server/models"
+)
+
+// Resumable uploads implementing the tus 1.0 core protocol together with the
+// creation, termination and expiration extensions (http://tus.io/protocols/resumable-upload.html).
+// Partial uploads are kept in the staging directory and moved to the blob
+// storage once complete.
+
+const (
+	tusVersion         = "1.0.0"
+	tusExtensions      = "creation,termination,expiration"
+	tusContentType     = "application/offset+octet-stream"
+	tusUploadLifetime  = 24 * time.Hour
+	tusCleanupInterval = time.Hour
+)
+
+// Uploads currently receiving a PATCH request. Concurrent PATCHes to the same
+// upload are refused.
+var tusLocks = struct {
+	sync.Mutex
+	uploads map[string]bool
+}{uploads: map[string]bool{}}
+
+func tusLock(id string) bool {
+	tusLocks.Lock()
+	defer tusLocks.Unlock()
+
+	if tusLocks.uploads[id] {
+		return false
+	}
+
+	tusLocks.uploads[id] = true
+	return true
+}
+
+func tusUnlock(id string) {
+	tusLocks.Lock()
+	defer tusLocks.Unlock()
+
+	delete(tusLocks.uploads, id)
+}
+
+func tusStagingPath(id string) string {
+	return filepath.Join(*uploadStaging, id)
+}
+
+// tusPrepare sets the headers every tus response carries and checks that the
+// client speaks our protocol version
+func tusPrepare(resp http.ResponseWriter, req *http.Request) bool {
+	resp.Header().Set("Tus-Resumable", tusVersion)
+
+	if req.Header.Get("Tus-Resumable") != tusVersion {
+		resp.Header().Set("Tus-Version", tusVersion)
+		httpresponse.Error(http.StatusPreconditionFailed, "Unsupported tus version").WriteJSON(resp)
+		return false
+	}
+
+	return true
+}
+
+// parseTusMetadata decodes the Upload-Metadata header, a comma separated list
+// of "key base64(value)" pairs
+func parseTusMetadata(header string) map[string]string {
+	metadata := map[string]string{}
+
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 {
+			continue
+		}
+
+		value := ""
+		if len(fields) > 1 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				continue
+			}
+			value = string(decoded)
+		}
+
+		metadata[fields[0]] = value
+	}
+
+	return metadata
+}
+
+// findUserUpload loads the upload referenced in the URL. An error response is
+// written if it doesn't exist or belongs to somebody else.
+func findUserUpload(resp http.ResponseWriter, req *http.Request, user models.User) (models.Upload, bool) {
+	vars := mux.Vars(req)
+	uploadID := vars["id"]
+
+	upload, err := models.FindUpload(DB, uploadID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.WithFields(log.Fields{"user": user.ID, "upload": uploadID, "error": err}).Error("SQL error while finding upload")
+		}
+
+		httpresponse.NotFound("No such upload").WriteJSON(resp)
+		return upload, false
+	}
+
+	if upload.UserID != user.ID {
+		httpresponse.NotFound("No such upload").WriteJSON(resp)
+		return upload, false
+	}
+
+	if upload.ExpiresAt.Before(time.Now()) {
+		httpresponse.Error(http.StatusGone, "Upload expired").WriteJSON(resp)
+		return upload, false
+	}
+
+	return upload, true
+}
+
+func setTusUploadHeaders(resp http.ResponseWriter, upload models.Upload) {
+	resp.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	resp.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if !upload.Completed {
+		resp.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+// finishUpload moves a completely received upload to the blob storage
+func finishUpload(upload *models.Upload) error {
+	f, err := os.Open(tusStagingPath(upload.ID))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	attachment, err := storeUpload(upload.UserID, upload.ID, f, upload.FileName)
+	if err != nil {
+		deleteUpload(upload.ID)
+		return err
+	}
+
+	upload.MimeType = attachment.MimeType
+	upload.SHA256 = attachment.SHA256
+	upload.Completed = true
+
+	if err := upload.Update(DB); err != nil {
+		deleteUpload(upload.ID)
+		return err
+	}
+
+	os.Remove(tusStagingPath(upload.ID))
+
+	return nil
+}
+
+func TusOptionsHandler(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Tus-Resumable", tusVersion)
+	resp.Header().Set("Tus-Version", tusVersion)
+	resp.Header().Set("Tus-Extension", tusExtensions)
+	resp.Header().Set("Tus-Max-Size", strconv.FormatInt(*maxUploadSize, 10))
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func TusCreateHandler(resp http.ResponseWriter, req *http.Request) {
+	if !tusPrepare(resp, req) {
+		return
+	}
+
+	user, ok := context.Get(req, ContextKeyUser).(models.User)
+	if !ok {
+		httpresponse.InternalServerError("Could not convert user").WriteJSON(resp)
+		return
+	}
+
+	length, err := strconv.ParseInt(req.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		httpresponse.BadRequest("Upload-Length has to be a non-negative number").WriteJSON(resp)
+		return
+	}
+
+	if length > user.UploadLimit(*maxUploadSize) {
+		httpresponse.Error(http.StatusRequestEntityTooLarge, "Upload too large").WriteJSON(resp)
+		return
+	}
+
+	limits, err := user.StorageLimits(DB)
+	if err != nil {
+		log.WithFields(log.Fields{"user": user.ID, "error": err}).Error("SQL error while loading storage limits")
+		httpresponse.InternalServerError("Could not load storage limits").WriteJSON(resp)
+		return
+	}
+
+	if !limits.Allows(user.StorageUsage, length) {
+		writeQuotaExceeded(resp)
+		return
+	}
+
+	metadata := parseTusMetadata(req.Header.Get("Upload-Metadata"))
+	fileName := metadata["filename"]
+	if fileName == "" {
+		fileName = metadata["name"]
+	}
+
+	upload := models.Upload{
+		UserID:    user.ID,
+		Length:    length,
+		FileName:  fileName,
+		ExpiresAt: time.Now().Add(tusUploadLifetime),
+	}
+
+	if err := upload.Create(DB); err != nil {
+		log.WithFields(log.Fields{"user": user.ID, "error": err}).Error("SQL error while creating upload")
+		httpresponse.InternalServerError("Creating the upload failed").WriteJSON(resp)
+		return
+	}
+
+	f, err := os.Create(tusStagingPath(upload.ID))
+	if err != nil {
+		log.WithFields(log.Fields{"upload": upload.ID, "error": err}).Error("Could not create staging file")
+		httpresponse.InternalServerError("Creating the upload failed").WriteJSON(resp)
+		upload.Delete(DB)
+		return
+	}
+	f.Close()
+
+	if length == 0 {
+		if err := finishUpload(&upload); err != nil {
+			log.WithFields(log.Fields{"upload": upload.ID, "error": err}).Error("Could not finish empty upload")
+			httpresponse.InternalServerError("Creating the upload failed").WriteJSON(resp)
+			return
+		}
+	}
+
+	setTusUploadHeaders(resp, upload)
+	resp.Header().Set("Location", "/uploads/"+upload.ID)
+	resp.WriteHeader(http.StatusCreated)
+}
+
+func TusHeadHandler(resp http.ResponseWriter, req *http.Request) {
+	if !tusPrepare(resp, req) {
+		return
+	}
+
+	user, ok := context.Get(req, ContextKeyUser).(models.User)
+	if !ok {
+		httpresponse.InternalServerError("Could not convert user").WriteJSON(resp)
+		return
+	}
+
+	upload, ok := findUserUpload(resp, req, user)
+	if !ok {
+		return
+	}
+
+	setTusUploadHeaders(resp, upload)
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.WriteHeader(http.StatusOK)
+}
+
+func TusPatchHandler(resp http.ResponseWriter, req *http.Request) {
+	if !tusPrepare(resp, req) {
+		return
+	}
+
+	user, ok := context.Get(req, ContextKeyUser).(models.User)
+	if !ok {
+		httpresponse.InternalServerError("Could not convert user").WriteJSON(resp)
+		return
+	}
+
+	if req.Header.Get("Content-Type") != tusContentType {
+		httpresponse.Error(http.StatusUnsupportedMediaType, "Content-Type has to be "+tusContentType).WriteJSON(resp)
+		return
+	}
+
+	offset, err := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		httpresponse.BadRequest("Upload-Offset has to be a non-negative number").WriteJSON(resp)
+		return
+	}
+
+	upload, ok := findUserUpload(resp, req, user)
+	if !ok {
+		return
+	}
+
+	if !tusLock(upload.ID) {
+		httpresponse.Error(http.StatusLocked, "Upload is being written to").WriteJSON(resp)
+		return
+	}
+	defer tusUnlock(upload.ID)
+
+	// Reload, another request might have finished in the meantime
+	if upload, err = models.FindUpload(DB, upload.ID); err != nil {
+		httpresponse.NotFound("No such upload").WriteJSON(resp)
+		return
+	}
+
+	if offset != upload.Offset {
+		httpresponse.Error(http.StatusConflict, "Upload-Offset does not match").WriteJSON(resp)
+		return
+	}
+
+	if !upload.Completed {
+		f, err := os.OpenFile(tusStagingPath(upload.ID), os.O_WRONLY, 0666)
+		if err != nil {
+			log.WithFields(log.Fields{"upload": upload.ID, "error": err}).Error("Could not open staging file")
+			httpresponse.InternalServerError("Writing the upload failed").WriteJSON(resp)
+			return
+		}
+		defer f.Close()
+
+		// Drop whatever a previous, interrupted request wrote beyond the
+		// acknowledged offset
+		if err := f.Truncate(upload.Offset); err == nil {
+			_, err = f.Seek(upload.Offset, io.SeekStart)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"upload": upload.ID, "error": err}).Error("Could not seek staging file")
+			httpresponse.InternalServerError("Writing the upload failed").WriteJSON(resp)
+			return
+		}
+
+		written, copyErr := io.Copy(f, io.LimitReader(req.Body, upload.Length-upload.Offset))
+
+		// Keep what we got even if the connection broke, the client will resume
+		upload.Offset += written
+		upload.ExpiresAt = time.Now().Add(tusUploadLifetime)
+		if err := upload.Update(DB); err != nil {
+			log.WithFields(log.Fields{"upload": upload.ID, "error": err}).Error("SQL error while updating upload")
+			httpresponse.InternalServerError("Writing the upload failed").WriteJSON(resp)
+			return
+		}
+
+		if copyErr != nil {
+			log.WithFields(log.Fields{"upload": upload.ID, "error": copyErr}).Warn("Upload interrupted")
+			httpresponse.InternalServerError("Upload interrupted").WriteJSON(resp)
+			return
+		}
+
+		if upload.Offset == upload.Length {
+			if err := finishUpload(&upload); err != nil {
+				log.WithFields(log.Fields{"upload": upload.ID, "error": err}).Error("Could not finish upload")
+				httpresponse.InternalServerError("Storing the upload failed").WriteJSON(resp)
+				return
+			}
+		}
+	}
+
+	setTusUploadHeaders(resp, upload)
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func TusDeleteHandler(resp http.ResponseWriter, req *http.Request) {
+	if !tusPrepare(resp, req) {
+		return
+	}
+
+	user, ok := context.Get(req, ContextKeyUser).(models.User)
+	if !ok {
+		httpresponse.InternalServerError("Could not convert user").WriteJSON(resp)
+		return
+	}
+
+	upload, ok := findUserUpload(resp, req, user)
+	if !ok {
+		return
+	}
+
+	removeUpload(upload)
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// removeUpload throws away an upload together with its data
+func removeUpload(upload models.Upload) {
+	os.Remove(tusStagingPath(upload.ID))
+
+	// A message which failed to send might have shared the file meanwhile
+	if upload.Completed {
+		shared, err := models.IsBlob(DB, upload.ID)
+		if err != nil {
+			log.WithFields(log.Fields{"upload": upload.ID, "error": err}).Error("SQL error while checking upload")
+			return
+		}
+
+		if !shared {
+			deleteUpload(upload.ID)
+		}
+	}
+
+	if err := upload.Delete(DB); err != nil {
+		log.WithFields(log.Fields{"upload": upload.ID, "error": err}).Warn("Could not delete upload")
+	}
+}
+
+// expireUploads periodically removes uploads which were neither finished nor
+// attached to a message in time
+func expireUploads() {
+	for range time.Tick(tusCleanupInterval) {
+		uploads, err := models.FindExpiredUploads(DB)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("SQL error while finding expired uploads")
+			continue
+		}
+
+		for _, upload := range uploads {
+			removeUpload(upload)
+		}
+	}
+}
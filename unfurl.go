@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/irrenhaus/pushmearound_server/events"
+	"github.com/irrenhaus/pushmearound_server/models"
+	"github.com/irrenhaus/pushmearound_server/unfurl"
+)
+
+// Fetcher used for link previews, nil if unfurling is disabled
+var LinkFetcher *unfurl.Fetcher
+
+// How long fetched previews are reused for other messages with the same URL
+const previewCacheTTL = time.Hour
+
+// Entries beyond this are not cached, so the cache can't grow without bound
+const previewCacheSize = 1024
+
+type cachedPreview struct {
+	Preview   json.RawMessage
+	FetchedAt time.Time
+}
+
+// previewCache remembers recently fetched previews by URL. Failed fetches are
+// remembered as well, so a broken page isn't hammered by every message.
+var previewCache = struct {
+	sync.Mutex
+	entries map[string]cachedPreview
+}{entries: map[string]cachedPreview{}}
+
+// Messages waiting for their link preview. If the queue is full the message
+// simply stays without a preview.
+var unfurlQueue = make(chan models.Message, 64)
+
+func setupUnfurl() {
+	if *unfurlEnabled {
+		LinkFetcher = unfurl.NewFetcher(*unfurlTimeout, *unfurlMaxSize)
+	}
+}
+
+// queueUnfurl schedules fetching the link preview of a URL message without
+// blocking the request
+func queueUnfurl(msg models.Message) {
+	if LinkFetcher == nil || msg.URL == "" {
+		return
+	}
+
+	select {
+	case unfurlQueue <- msg:
+	default:
+		log.WithFields(log.Fields{"message": msg.ID}).Warn("Unfurl queue is full, skipping link preview")
+	}
+}
+
+// runUnfurler fetches the queued link previews in the background
+func runUnfurler() {
+	for msg := range unfurlQueue {
+		preview, err := linkPreview(msg.URL)
+		if err != nil {
+			log.WithFields(log.Fields{"message": msg.ID, "url": msg.URL, "error": err}).Info("Could not fetch link preview")
+			continue
+		}
+		if preview == nil {
+			continue
+		}
+
+		if err := models.SetMessagePreview(DB, &msg, preview); err != nil {
+			log.WithFields(log.Fields{"message": msg.ID, "error": err}).Error("SQL error while storing link preview")
+			continue
+		}
+
+		Events.Publish(msg.UserID, events.Event{
+			Type: events.TypePreviewReady,
+			Data: map[string]interface{}{
+				"message_id": msg.ID,
+				"preview":    msg.Preview,
+			},
+		})
+	}
+}
+
+// linkPreview returns the preview of a page, from the cache if possible. A
+// nil preview means the page has nothing worth showing.
+func linkPreview(url string) (json.RawMessage, error) {
+	previewCache.Lock()
+	cached, ok := previewCache.entries[url]
+	previewCache.Unlock()
+
+	if ok && time.Since(cached.FetchedAt) < previewCacheTTL {
+		return cached.Preview, nil
+	}
+
+	var preview json.RawMessage
+	page, err := LinkFetcher.Fetch(url)
+	switch err {
+	case nil:
+		if page.Title != "" || page.Description != "" || page.ImageURL != "" {
+			if preview, err = json.Marshal(page); err != nil {
+				return nil, err
+			}
+		}
+	case unfurl.ErrForbiddenAddress, unfurl.ErrNotHTML:
+		// Not going to change, remember that there is no preview
+	default:
+		return nil, err
+	}
+
+	previewCache.Lock()
+	defer previewCache.Unlock()
+
+	now := time.Now()
+	if len(previewCache.entries) >= previewCacheSize {
+		for key, entry := range previewCache.entries {
+			if now.Sub(entry.FetchedAt) >= previewCacheTTL {
+				delete(previewCache.entries, key)
+			}
+		}
+	}
+	if len(previewCache.entries) < previewCacheSize {
+		previewCache.entries[url] = cachedPreview{Preview: preview, FetchedAt: now}
+	}
+
+	return preview, nil
+}
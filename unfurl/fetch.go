@@ -0,0 +1,215 @@
+package unfurl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+var ErrForbiddenAddress = errors.New("Address not allowed")
+var ErrNotHTML = errors.New("Not an HTML page")
+
+// Redirects followed before giving up
+const maxRedirects = 5
+
+// Ranges which must never be fetched on behalf of users: private networks,
+// loopback, link local and other special purpose addresses
+var blockedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"100::/64",
+	"2001:db8::/32",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks
+}
+
+// IsPublicIP reports whether ip may be fetched from
+func IsPublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Fetcher downloads web pages to build link previews. Connections are only
+// made to public addresses; the check happens after name resolution so that
+// DNS tricks don't get around it.
+type Fetcher struct {
+	client   *http.Client
+	maxBytes int64
+	// AllowPrivate disables the address check, for testing against local
+	// servers only
+	AllowPrivate bool
+}
+
+// publicTransport creates the transport for a client talking to URLs given by
+// users. control vets every address before connecting. Each client gets a
+// transport, and with it a connection pool, of its own.
+func publicTransport(timeout time.Duration, control func(network string, address string, c syscall.RawConn) error) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: control,
+	}
+
+	return &http.Transport{
+		// Proxies would make the address check useless
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       time.Minute,
+	}
+}
+
+// NewFetcher creates a fetcher giving up after timeout and reading at most
+// maxBytes of a page
+func NewFetcher(timeout time.Duration, maxBytes int64) *Fetcher {
+	f := &Fetcher{maxBytes: maxBytes}
+
+	f.client = &http.Client{
+		Timeout:   timeout,
+		Transport: publicTransport(timeout, f.checkAddress),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return errors.New("Too many redirects")
+			}
+
+			return CheckURL(req.URL)
+		},
+	}
+
+	return f
+}
+
+// NewPublicClient creates a client which only connects to public addresses
+// and doesn't follow redirects, for requests to URLs given by users
+func NewPublicClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: publicTransport(timeout, checkPublicAddress),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func (f *Fetcher) checkAddress(network string, address string, c syscall.RawConn) error {
+	if f.AllowPrivate {
+		return nil
+	}
+
+	return checkPublicAddress(network, address, c)
+}
+
+func checkPublicAddress(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !IsPublicIP(ip) {
+		return ErrForbiddenAddress
+	}
+
+	return nil
+}
+
+// CheckURL reports whether u may be requested on behalf of a user
+func CheckURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("Unsupported scheme %s", u.Scheme)
+	}
+
+	if u.Hostname() == "" {
+		return errors.New("No host")
+	}
+
+	return nil
+}
+
+// Fetch downloads the page at rawURL and extracts its preview
+func (f *Fetcher) Fetch(rawURL string) (Preview, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return Preview{}, err
+	}
+
+	if err := CheckURL(u); err != nil {
+		return Preview{}, err
+	}
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return Preview{}, err
+	}
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	req.Header.Set("User-Agent", "pushmearound link preview")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		// The address check fails deep inside the transport
+		if errors.Is(err, ErrForbiddenAddress) {
+			return Preview{}, ErrForbiddenAddress
+		}
+		return Preview{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Preview{}, fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return Preview{}, ErrNotHTML
+	}
+
+	preview := parsePreview(io.LimitReader(resp.Body, f.maxBytes), resp.Request.URL)
+	preview.URL = resp.Request.URL.String()
+
+	return preview, nil
+}
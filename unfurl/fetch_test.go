@@ -0,0 +1,263 @@
+package unfurl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestFetcher(timeout time.Duration, maxBytes int64) *Fetcher {
+	f := NewFetcher(timeout, maxBytes)
+	f.AllowPrivate = true
+
+	return f
+}
+
+func TestFetch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(resp, `<!DOCTYPE html>
+<html>
+<head>
+<title>Plain &amp; simple</title>
+<meta name="description" content="A page about things">
+<meta property="og:image" content="/images/preview.png">
+<meta property="og:site_name" content="Example">
+</head>
+<body><p>Content</p></body>
+</html>`)
+	}))
+	defer server.Close()
+
+	preview, err := newTestFetcher(5*time.Second, 1<<20).Fetch(server.URL + "/article")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Preview{
+		URL:         server.URL + "/article",
+		Title:       "Plain & simple",
+		Description: "A page about things",
+		ImageURL:    server.URL + "/images/preview.png",
+		SiteName:    "Example",
+	}
+	if preview != want {
+		t.Errorf("Fetch returned %+v, want %+v", preview, want)
+	}
+}
+
+func TestFetchFollowsRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/short", func(resp http.ResponseWriter, req *http.Request) {
+		http.Redirect(resp, req, "/blog/post", http.StatusFound)
+	})
+	mux.HandleFunc("/blog/post", func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(resp, `<html><head><title>Post</title><meta property="og:image" content="cover.jpg"></head></html>`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	preview, err := newTestFetcher(5*time.Second, 1<<20).Fetch(server.URL + "/short")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if preview.URL != server.URL+"/blog/post" {
+		t.Errorf("Fetch returned URL %s, want the redirect target", preview.URL)
+	}
+
+	// Relative image URLs are resolved against the page they were found on
+	if preview.ImageURL != server.URL+"/blog/cover.jpg" {
+		t.Errorf("Fetch returned image %s, want %s", preview.ImageURL, server.URL+"/blog/cover.jpg")
+	}
+}
+
+func TestFetchMaxBytes(t *testing.T) {
+	padding := "<!-- " + strings.Repeat("x", 2000) + " -->"
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(resp, `<html><head><meta name="description" content="Early">%s<title>Too late</title></head></html>`, padding)
+	}))
+	defer server.Close()
+
+	preview, err := newTestFetcher(5*time.Second, 1000).Fetch(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if preview.Title != "" {
+		t.Errorf("Fetch read past maxBytes, found title %q", preview.Title)
+	}
+	if preview.Description != "Early" {
+		t.Errorf("Fetch returned description %q, want what came before the cutoff", preview.Description)
+	}
+
+	preview, err = newTestFetcher(5*time.Second, 1<<20).Fetch(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.Title != "Too late" {
+		t.Errorf("Fetch returned title %q with enough room", preview.Title)
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	start := time.Now()
+	if _, err := newTestFetcher(200*time.Millisecond, 1<<20).Fetch(server.URL); err == nil {
+		t.Fatal("Fetch succeeded although the server never answered")
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Fetch gave up after %s, want about the timeout", elapsed)
+	}
+}
+
+func TestFetchRefusesNonHTML(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/missing" {
+			http.NotFound(resp, req)
+			return
+		}
+
+		resp.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(resp, `{"title": "<title>Not a page</title>"}`)
+	}))
+	defer server.Close()
+
+	f := newTestFetcher(5*time.Second, 1<<20)
+
+	if _, err := f.Fetch(server.URL); err != ErrNotHTML {
+		t.Errorf("Fetch of JSON returned %v, want ErrNotHTML", err)
+	}
+	if _, err := f.Fetch(server.URL + "/missing"); err == nil {
+		t.Error("Fetch of a missing page succeeded")
+	}
+}
+
+func TestFetchRefusesSchemes(t *testing.T) {
+	f := newTestFetcher(5*time.Second, 1<<20)
+
+	for _, rawURL := range []string{"ftp://example.com/", "file:///etc/passwd", "javascript:alert(1)", "http:///path"} {
+		if _, err := f.Fetch(rawURL); err == nil {
+			t.Errorf("Fetch of %s succeeded", rawURL)
+		}
+	}
+}
+
+func TestFetchBlocksPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(resp, `<html><head><title>Internal</title></head></html>`)
+	}))
+	defer server.Close()
+
+	if _, err := NewFetcher(5*time.Second, 1<<20).Fetch(server.URL); err != ErrForbiddenAddress {
+		t.Errorf("Fetch of a loopback address returned %v, want ErrForbiddenAddress", err)
+	}
+}
+
+func TestFetchBlocksRedirectsToPrivateAddresses(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		t.Error("The internal server was reached")
+	}))
+	defer internal.Close()
+
+	public := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		http.Redirect(resp, req, internal.URL+"/admin", http.StatusFound)
+	}))
+	defer public.Close()
+
+	f := NewFetcher(5*time.Second, 1<<20)
+
+	// Pretend public.example is a public host served by the public test
+	// server, everything else goes through the checked dialer
+	transport := f.client.Transport.(*http.Transport)
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		if address == "public.example:80" {
+			return (&net.Dialer{}).DialContext(ctx, network, public.Listener.Addr().String())
+		}
+
+		return dial(ctx, network, address)
+	}
+
+	if _, err := f.Fetch("http://public.example/"); err != ErrForbiddenAddress {
+		t.Errorf("Fetch following a redirect to a loopback address returned %v, want ErrForbiddenAddress", err)
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"8.8.8.8", true},
+		{"93.184.216.34", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"2606:4700::1111", true},
+		{"::1", false},
+		{"::", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"ff02::1", false},
+
+		// IPv4-mapped addresses are checked like the IPv4 address
+		{"::ffff:8.8.8.8", true},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+
+		// NAT64 addresses are refused altogether, the embedded IPv4 address
+		// could be anything
+		{"64:ff9b::7f00:1", false},
+		{"64:ff9b::a00:1", false},
+		{"64:ff9b::808:808", false},
+	}
+
+	for _, test := range tests {
+		ip := net.ParseIP(test.ip)
+		if ip == nil {
+			t.Fatalf("Invalid test address %s", test.ip)
+		}
+
+		if public := IsPublicIP(ip); public != test.public {
+			t.Errorf("IsPublicIP(%s) = %t, want %t", test.ip, public, test.public)
+		}
+	}
+}
+
+func TestNewPublicClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		t.Error("The loopback server was reached")
+	}))
+	defer server.Close()
+
+	_, err := NewPublicClient(5 * time.Second).Get(server.URL)
+	if !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("Get of a loopback address returned %v, want ErrForbiddenAddress", err)
+	}
+}
@@ -0,0 +1,136 @@
+package unfurl
+
+import (
+	"encoding/xml"
+	"io"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// Longest title and description kept in a preview
+const maxPreviewText = 500
+
+// Preview describes a linked page. URL is where the page was found after
+// following redirects.
+type Preview struct {
+	URL         string
+	Title       string
+	Description string
+	ImageURL    string
+	SiteName    string
+}
+
+// parsePreview extracts title, description and the OpenGraph data from the
+// head of an HTML page. The lenient XML decoder copes with most real world
+// HTML; whatever was found before it gives up is used.
+func parsePreview(r io.Reader, base *url.URL) Preview {
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+
+	var title, description, ogTitle, ogDescription, ogImage, ogSiteName string
+	inTitle := false
+
+loop:
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch strings.ToLower(t.Name.Local) {
+			case "title":
+				inTitle = true
+			case "body":
+				break loop
+			case "meta":
+				name, content := metaAttributes(t.Attr)
+				switch name {
+				case "description":
+					description = content
+				case "og:title":
+					ogTitle = content
+				case "og:description":
+					ogDescription = content
+				case "og:image", "og:image:url", "og:image:secure_url":
+					if ogImage == "" {
+						ogImage = content
+					}
+				case "og:site_name":
+					ogSiteName = content
+				}
+			}
+		case xml.EndElement:
+			switch strings.ToLower(t.Name.Local) {
+			case "title":
+				inTitle = false
+			case "head":
+				break loop
+			}
+		case xml.CharData:
+			if inTitle {
+				title += string(t)
+			}
+		}
+	}
+
+	preview := Preview{
+		Title:       cleanText(firstOf(ogTitle, title)),
+		Description: cleanText(firstOf(ogDescription, description)),
+		SiteName:    cleanText(ogSiteName),
+	}
+
+	if ogImage != "" {
+		if image, err := base.Parse(strings.TrimSpace(ogImage)); err == nil && (image.Scheme == "http" || image.Scheme == "https") {
+			preview.ImageURL = image.String()
+		}
+	}
+
+	return preview
+}
+
+// metaAttributes returns the name (or OpenGraph property) and content of a
+// meta tag
+func metaAttributes(attrs []xml.Attr) (string, string) {
+	var name, content string
+	for _, attr := range attrs {
+		switch strings.ToLower(attr.Name.Local) {
+		case "name", "property":
+			if name == "" {
+				name = strings.ToLower(strings.TrimSpace(attr.Value))
+			}
+		case "content":
+			content = attr.Value
+		}
+	}
+
+	return name, content
+}
+
+func firstOf(values ...string) string {
+	for _, value := range values {
+		if strings.TrimSpace(value) != "" {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// cleanText collapses whitespace and shortens overly long texts
+func cleanText(value string) string {
+	value = strings.Join(strings.Fields(value), " ")
+	if utf8.RuneCountInString(value) <= maxPreviewText {
+		return value
+	}
+
+	runes := []rune(value)
+	return string(runes[:maxPreviewText-1]) + "…"
+}
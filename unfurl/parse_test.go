@@ -0,0 +1,83 @@
+package unfurl
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestParsePreview(t *testing.T) {
+	base, _ := url.Parse("https://example.com/news/article.html")
+
+	tests := []struct {
+		name string
+		html string
+		want Preview
+	}{
+		{
+			name: "title and description",
+			html: `<html><head><title> Hello
+				World </title><meta name="Description" content="About it"></head></html>`,
+			want: Preview{Title: "Hello World", Description: "About it"},
+		},
+		{
+			name: "OpenGraph wins",
+			html: `<html><head><title>Page title</title>
+				<meta name="description" content="Page description">
+				<meta property="og:title" content="OG title">
+				<meta property="og:description" content="OG description">
+				<meta property="og:site_name" content="Example News"></head></html>`,
+			want: Preview{Title: "OG title", Description: "OG description", SiteName: "Example News"},
+		},
+		{
+			name: "relative image",
+			html: `<html><head><meta property="og:image" content="../img/cover.png"></head></html>`,
+			want: Preview{ImageURL: "https://example.com/img/cover.png"},
+		},
+		{
+			name: "protocol relative image",
+			html: `<html><head><meta property="og:image" content="//cdn.example.net/cover.png"></head></html>`,
+			want: Preview{ImageURL: "https://cdn.example.net/cover.png"},
+		},
+		{
+			name: "first image counts",
+			html: `<html><head><meta property="og:image:secure_url" content="https://example.com/a.png">
+				<meta property="og:image" content="https://example.com/b.png"></head></html>`,
+			want: Preview{ImageURL: "https://example.com/a.png"},
+		},
+		{
+			name: "image with unsupported scheme",
+			html: `<html><head><meta property="og:image" content="javascript:alert(1)"></head></html>`,
+			want: Preview{},
+		},
+		{
+			name: "sloppy HTML",
+			html: `<HTML><HEAD><META charset=utf-8><TITLE>Caf&eacute; &amp; bar</TITLE><link rel=stylesheet href=a.css></HEAD>`,
+			want: Preview{Title: "Café & bar"},
+		},
+		{
+			name: "body is ignored",
+			html: `<html><head></head><body><title>Not the title</title></body></html>`,
+			want: Preview{},
+		},
+	}
+
+	for _, test := range tests {
+		preview := parsePreview(strings.NewReader(test.html), base)
+		if preview != test.want {
+			t.Errorf("%s: parsePreview returned %+v, want %+v", test.name, preview, test.want)
+		}
+	}
+}
+
+func TestCleanText(t *testing.T) {
+	if text := cleanText("  a \n\t b  "); text != "a b" {
+		t.Errorf("cleanText returned %q, want %q", text, "a b")
+	}
+
+	text := cleanText(strings.Repeat("ä", maxPreviewText+10))
+	if utf8.RuneCountInString(text) != maxPreviewText || !strings.HasSuffix(text, "…") {
+		t.Errorf("cleanText returned %d characters, want %d ending in an ellipsis", utf8.RuneCountInString(text), maxPreviewText)
+	}
+}